@@ -0,0 +1,113 @@
+package cache
+
+const (
+	listT1 uint8 = iota
+	listT2
+)
+
+// arc is the Adaptive Replacement Cache. t1 holds entries seen once and t2
+// entries seen again, b1 and b2 remember the keys evicted from each. A miss
+// on a key in b1 means t1 was too small and grows its target size p, a miss
+// on a key in b2 shrinks it. All sizes are costs.
+type arc[K comparable, V any] struct {
+	t1, t2   queue[K, V]
+	b1, b2   ghost[K, V]
+	p        int64
+	capacity int64
+
+	// returning is an incoming key that was found in a ghost, from is that
+	// ghost. Eviction comes before add, and as in the paper it has to see p
+	// adapted already.
+	returning K
+	from      *ghost[K, V]
+}
+
+func newARC[K comparable, V any](capacity int64) *arc[K, V] {
+	return &arc[K, V]{
+		t1:       newQueue[K, V](),
+		t2:       newQueue[K, V](),
+		b1:       newGhost[K, V](capacity),
+		b2:       newGhost[K, V](capacity),
+		capacity: capacity,
+	}
+}
+
+func (a *arc[K, V]) add(n *node[K, V]) {
+	returning := a.adapt(n.key)
+	a.from = nil
+	if !returning {
+		n.list = listT1
+		a.t1.pushFront(n)
+		return
+	}
+	n.list = listT2
+	a.t2.pushFront(n)
+}
+
+// adapt moves p towards the list the ghost of key was evicted from, once
+// per miss. It reports whether key was a ghost.
+func (a *arc[K, V]) adapt(key K) bool {
+	if a.from != nil && a.returning == key {
+		return true
+	}
+	if g, ok := a.b1.hash[key]; ok {
+		a.p = min(a.p+g.cost*max(a.b2.queue.cost/max(a.b1.queue.cost, 1), 1), a.capacity)
+		a.b1.remove(key)
+		a.returning, a.from = key, &a.b1
+		return true
+	}
+	if g, ok := a.b2.hash[key]; ok {
+		a.p = max(a.p-g.cost*max(a.b1.queue.cost/max(a.b2.queue.cost, 1), 1), 0)
+		a.b2.remove(key)
+		a.returning, a.from = key, &a.b2
+		return true
+	}
+	return false
+}
+
+func (a *arc[K, V]) hit(n *node[K, V]) {
+	a.remove(n)
+	n.list = listT2
+	a.t2.pushFront(n)
+}
+
+func (a *arc[K, V]) remove(n *node[K, V]) {
+	if n.list == listT2 {
+		a.t2.remove(n)
+		return
+	}
+	a.t1.remove(n)
+}
+
+func (a *arc[K, V]) resize(n *node[K, V], cost int64) {
+	if n.list == listT2 {
+		a.t2.resize(n, cost)
+		return
+	}
+	a.t1.resize(n, cost)
+}
+
+func (a *arc[K, V]) evict(incoming K) *node[K, V] {
+	var n *node[K, V]
+	returning := a.adapt(incoming)
+	if a.t1.length > 0 && (a.t1.cost > a.p || (a.t1.cost == a.p && returning && a.from == &a.b2) || a.t2.length == 0) {
+		n = a.t1.back()
+		a.t1.remove(n)
+		a.b1.add(n)
+	} else if n = a.t2.back(); n != nil {
+		a.t2.remove(n)
+		a.b2.add(n)
+	}
+	// t1 and b1 together stay within the capacity, all four lists within
+	// twice of it
+	a.b1.trim(a.capacity - a.t1.cost)
+	a.b2.trim(2*a.capacity - a.t1.cost - a.t2.cost - a.b1.queue.cost)
+	return n
+}
+
+func (a *arc[K, V]) walk(f func(n *node[K, V])) {
+	a.t2.walk(f)
+	a.t1.walk(f)
+}
+
+func (a *arc[K, V]) len() int { return a.t1.length + a.t2.length }
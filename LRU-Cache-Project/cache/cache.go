@@ -0,0 +1,482 @@
+// Package cache is a generic, concurrency-safe cache. Entries are found
+// through a hash map and ordered by an eviction policy, LRU by default, over
+// doubly linked queues, so every operation takes constant time.
+package cache
+
+import (
+	"fmt"
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EvictionReason tells OnEvict why an entry left the cache.
+type EvictionReason int
+
+const (
+	// ReasonCapacity is an entry evicted to make room for another, or one
+	// costing more than the capacity, which isn't stored and takes the
+	// value of its key along.
+	ReasonCapacity EvictionReason = iota
+	// ReasonExpired is an entry whose TTL ran out.
+	ReasonExpired
+	// ReasonDeleted is an entry removed by Delete.
+	ReasonDeleted
+)
+
+func (r EvictionReason) String() string {
+	switch r {
+	case ReasonExpired:
+		return "expired"
+	case ReasonDeleted:
+		return "deleted"
+	}
+	return "capacity"
+}
+
+// Options configures a Cache.
+type Options[K comparable, V any] struct {
+	// Capacity is the total cost of the entries the cache holds before it
+	// evicts some. Without a Cost function every entry costs 1, so it's the
+	// number of entries.
+	Capacity int64
+
+	// Cost returns the cost of an entry, e.g. its size in bytes, to bound
+	// the memory rather than the number of entries. It is called once per
+	// Put and must not be negative; an entry costing more than the capacity
+	// of its shard isn't stored.
+	Cost func(key K, value V) int64
+
+	// Policy picks the entry to evict, LRU by default.
+	Policy Policy
+
+	// Shards splits the cache into independently locked parts to cut lock
+	// contention. Each shard holds its share of Capacity and runs the policy
+	// on its own entries, so the order is only kept within a shard. 0 or 1
+	// means one lock for the whole cache.
+	Shards int
+
+	// Hash spreads the keys over the shards. The default handles strings and
+	// integers directly and hashes the fmt formatting of other keys.
+	Hash func(key K) uint64
+
+	// TTL is how long entries stored by Put live, 0 means until they are
+	// evicted. PutWithTTL overrides it per entry.
+	TTL time.Duration
+
+	// CleanupInterval is how often a background goroutine removes expired
+	// entries. Expired entries are never returned either way, but without
+	// the cleanup they take up room until they are looked up or evicted.
+	// 0 turns the cleanup off; Close stops it.
+	CleanupInterval time.Duration
+
+	// ErrorTTL is how long GetOrLoad remembers that a loader failed, it
+	// returns the same error without calling a loader meanwhile. 0 turns
+	// this off.
+	ErrorTTL time.Duration
+
+	// RefreshAhead reloads entries GetOrLoad finds expiring within that
+	// time in the background, so entries in use don't expire and make their
+	// callers wait for a load. The current value is returned meanwhile.
+	RefreshAhead time.Duration
+
+	// OnEvict is called with every entry that leaves the cache, other than
+	// by being overwritten. It runs after the cache's lock is released, so
+	// it may use the cache.
+	OnEvict func(key K, value V, reason EvictionReason)
+
+	now func() time.Time // time.Now, unless a test controls the clock
+}
+
+// Cache is a fixed-capacity cache, safe for concurrent use.
+type Cache[K comparable, V any] struct {
+	shards  []*shard[K, V]
+	hash    func(key K) uint64
+	ttl     time.Duration
+	cost    func(key K, value V) int64
+	onEvict func(key K, value V, reason EvictionReason)
+	now     func() time.Time
+
+	errorTTL     time.Duration
+	refreshAhead time.Duration
+	loadMu       sync.Mutex
+	loads        map[K]*call[V] // loads in flight
+	failures     map[K]failure  // failed loads remembered for errorTTL
+
+	// counted outside the shards' locks, they happen less often than
+	// lookups
+	evictions   atomic.Uint64
+	expirations atomic.Uint64
+	loaded      atomic.Uint64
+	loadFailed  atomic.Uint64
+
+	stop      chan struct{}
+	stopped   chan struct{} // closed when the cleanup has stopped
+	closeOnce sync.Once
+}
+
+type shard[K comparable, V any] struct {
+	mu       sync.Mutex
+	capacity int64
+	cost     int64 // of all entries
+	policy   policy[K, V]
+	hash     hash[K, V]
+	hits     uint64
+	misses   uint64
+}
+
+// eviction is an entry removed under a shard's lock, OnEvict is called for
+// it once the lock is released.
+type eviction[K comparable, V any] struct {
+	node   *node[K, V]
+	reason EvictionReason
+}
+
+// New returns an empty cache. It panics when opts.Capacity isn't positive.
+func New[K comparable, V any](opts Options[K, V]) *Cache[K, V] {
+	if opts.Capacity < 1 {
+		panic("cache: capacity must be positive")
+	}
+	shards := max(opts.Shards, 1)
+	// every shard holds at least one entry
+	shards = int(min(int64(shards), opts.Capacity))
+
+	c := &Cache[K, V]{
+		shards:  make([]*shard[K, V], shards),
+		hash:    opts.Hash,
+		ttl:     opts.TTL,
+		cost:    opts.Cost,
+		onEvict: opts.OnEvict,
+		now:     opts.now,
+
+		errorTTL:     opts.ErrorTTL,
+		refreshAhead: opts.RefreshAhead,
+		loads:        map[K]*call[V]{},
+		failures:     map[K]failure{},
+
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if c.now == nil {
+		c.now = time.Now
+	}
+	if c.hash == nil {
+		c.hash = defaultHash[K](maphash.MakeSeed())
+	}
+	for i := range c.shards {
+		capacity := opts.Capacity / int64(shards)
+		if int64(i) < opts.Capacity%int64(shards) {
+			capacity++
+		}
+		c.shards[i] = &shard[K, V]{
+			capacity: capacity,
+			policy:   newPolicy[K, V](opts.Policy, capacity, c.hash),
+			hash:     hash[K, V]{},
+		}
+	}
+	if opts.CleanupInterval > 0 {
+		go c.cleanup(opts.CleanupInterval)
+	} else {
+		close(c.stopped)
+	}
+	return c
+}
+
+// Close stops the background cleanup. The cache stays usable, expired
+// entries are still removed when they are looked up.
+func (c *Cache[K, V]) Close() {
+	c.closeOnce.Do(func() { close(c.stop) })
+}
+
+func (c *Cache[K, V]) shardFor(key K) *shard[K, V] {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	return c.shards[c.hash(key)%uint64(len(c.shards))]
+}
+
+// Get returns the value of key and records the access with the policy.
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	value, _, ok := c.lookup(key, true)
+	return value, ok
+}
+
+// Peek returns the value of key without recording an access.
+func (c *Cache[K, V]) Peek(key K) (V, bool) {
+	value, _, ok := c.lookup(key, false)
+	return value, ok
+}
+
+// lookup returns the value of key and when it expires. Only lookups that
+// touch count as hits or misses.
+func (c *Cache[K, V]) lookup(key K, touch bool) (V, int64, bool) {
+	var evicted []eviction[K, V]
+	defer func() { c.notify(evicted) }()
+
+	s := c.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, ok := s.hash[key]
+	if ok && n.expired(c.now().UnixNano()) {
+		s.remove(n)
+		evicted = append(evicted, eviction[K, V]{n, ReasonExpired})
+		ok = false
+	}
+	if !ok {
+		if touch {
+			s.misses++
+		}
+		var zero V
+		return zero, 0, false
+	}
+	if touch {
+		s.hits++
+		s.policy.hit(n)
+	}
+	return n.value, n.expires, true
+}
+
+// TTL returns how long key has left to live, 0 when it doesn't expire. ok
+// is false when key isn't in the cache. It doesn't count as an access.
+func (c *Cache[K, V]) TTL(key K) (ttl time.Duration, ok bool) {
+	_, expires, ok := c.lookup(key, false)
+	if !ok || expires == 0 {
+		return 0, ok
+	}
+	// an entry expiring right now is still found, it has the least time left
+	return max(time.Unix(0, expires).Sub(c.now()), 1), true
+}
+
+// Put stores value under key, evicting other entries until its cost fits.
+// Overwriting an entry counts as an access. The entry lives for the cache's
+// TTL.
+func (c *Cache[K, V]) Put(key K, value V) {
+	c.PutWithTTL(key, value, c.ttl)
+}
+
+// PutWithTTL is Put with an entry of its own lifetime, 0 means the entry
+// doesn't expire.
+func (c *Cache[K, V]) PutWithTTL(key K, value V, ttl time.Duration) {
+	now := c.now()
+	var expires int64
+	if ttl > 0 {
+		expires = now.Add(ttl).UnixNano()
+	}
+	cost := int64(1)
+	if c.cost != nil {
+		cost = max(c.cost(key, value), 0)
+	}
+
+	var evicted []eviction[K, V]
+	defer func() { c.notify(evicted) }()
+
+	s := c.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, ok := s.hash[key]
+	if cost > s.capacity {
+		// the old value would be stale, it goes too
+		if ok {
+			s.remove(n)
+			reason := ReasonCapacity
+			if n.expired(now.UnixNano()) {
+				reason = ReasonExpired
+			}
+			evicted = append(evicted, eviction[K, V]{n, reason})
+		}
+		rejected := &node[K, V]{key: key, value: value, cost: cost}
+		evicted = append(evicted, eviction[K, V]{rejected, ReasonCapacity})
+		return
+	}
+	if ok {
+		n.value, n.expires = value, expires
+		s.cost += cost - n.cost
+		s.policy.resize(n, cost)
+		s.policy.hit(n)
+		// a bigger value may push out others, or even the entry itself
+		evicted = s.evict(key, 0, now.UnixNano())
+		return
+	}
+	evicted = s.evict(key, cost, now.UnixNano())
+	n = &node[K, V]{key: key, value: value, expires: expires, cost: cost}
+	s.policy.add(n)
+	s.hash[key] = n
+	s.cost += cost
+}
+
+// Delete removes key and reports whether it was present.
+func (c *Cache[K, V]) Delete(key K) bool {
+	var evicted []eviction[K, V]
+	defer func() { c.notify(evicted) }()
+
+	s := c.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, ok := s.hash[key]
+	if !ok {
+		return false
+	}
+	s.remove(n)
+	if n.expired(c.now().UnixNano()) {
+		evicted = append(evicted, eviction[K, V]{n, ReasonExpired})
+		return false
+	}
+	evicted = append(evicted, eviction[K, V]{n, ReasonDeleted})
+	return true
+}
+
+// Cost is the total cost of the entries in the cache, which is their number
+// without a Cost function. Like Len it includes expired entries the cleanup
+// hasn't removed yet.
+func (c *Cache[K, V]) Cost() int64 {
+	var cost int64
+	for _, s := range c.shards {
+		s.mu.Lock()
+		cost += s.cost
+		s.mu.Unlock()
+	}
+	return cost
+}
+
+// Len is the number of entries in the cache, expired entries the cleanup
+// hasn't removed yet included.
+func (c *Cache[K, V]) Len() int {
+	length := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		length += s.policy.len()
+		s.mu.Unlock()
+	}
+	return length
+}
+
+// Keys returns the keys, those the policy values most first, shard by shard
+// when the cache is sharded. For LRU that's the most recently used first.
+// Expired entries are left out.
+func (c *Cache[K, V]) Keys() []K {
+	now := c.now().UnixNano()
+	var keys []K
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.policy.walk(func(n *node[K, V]) {
+			if !n.expired(now) {
+				keys = append(keys, n.key)
+			}
+		})
+		s.mu.Unlock()
+	}
+	return keys
+}
+
+// cleanup removes the expired entries every interval until Close.
+func (c *Cache[K, V]) cleanup(interval time.Duration) {
+	defer close(c.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		// one shard at a time, the others stay available meanwhile
+		for _, s := range c.shards {
+			c.notify(s.removeExpired(c.now().UnixNano()))
+		}
+		c.forgetFailures(c.now().UnixNano())
+	}
+}
+
+func (c *Cache[K, V]) notify(evicted []eviction[K, V]) {
+	for _, e := range evicted {
+		switch e.reason {
+		case ReasonCapacity:
+			c.evictions.Add(1)
+		case ReasonExpired:
+			c.expirations.Add(1)
+		}
+		if c.onEvict != nil {
+			c.onEvict(e.node.key, e.node.value, e.reason)
+		}
+	}
+}
+
+func (s *shard[K, V]) remove(n *node[K, V]) {
+	s.policy.remove(n)
+	delete(s.hash, n.key)
+	s.cost -= n.cost
+}
+
+// evict gives up entries until one costing incoming fits in beside the
+// others.
+func (s *shard[K, V]) evict(key K, incoming int64, now int64) []eviction[K, V] {
+	var evicted []eviction[K, V]
+	for s.cost+incoming > s.capacity {
+		victim := s.policy.evict(key)
+		if victim == nil {
+			break
+		}
+		delete(s.hash, victim.key)
+		s.cost -= victim.cost
+		reason := ReasonCapacity
+		if victim.expired(now) {
+			reason = ReasonExpired
+		}
+		evicted = append(evicted, eviction[K, V]{victim, reason})
+	}
+	return evicted
+}
+
+func (s *shard[K, V]) removeExpired(now int64) []eviction[K, V] {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var evicted []eviction[K, V]
+	s.policy.walk(func(n *node[K, V]) {
+		if n.expired(now) {
+			evicted = append(evicted, eviction[K, V]{n, ReasonExpired})
+		}
+	})
+	for _, e := range evicted {
+		s.remove(e.node)
+	}
+	return evicted
+}
+
+// defaultHash hashes the common key types without formatting them.
+func defaultHash[K comparable](seed maphash.Seed) func(key K) uint64 {
+	return func(key K) uint64 {
+		switch k := any(key).(type) {
+		case string:
+			return maphash.String(seed, k)
+		case int:
+			return mix(uint64(k))
+		case int64:
+			return mix(uint64(k))
+		case int32:
+			return mix(uint64(k))
+		case uint:
+			return mix(uint64(k))
+		case uint64:
+			return mix(k)
+		case uint32:
+			return mix(uint64(k))
+		}
+		return maphash.String(seed, fmt.Sprint(key))
+	}
+}
+
+// mix is the splitmix64 finalizer, it spreads sequential integers over all
+// bits so they don't land in the same shards.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
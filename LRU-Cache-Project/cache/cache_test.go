@@ -0,0 +1,479 @@
+package cache
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+var policies = []Policy{LRU, LFU, TwoQueue, ARC, TinyLFU}
+
+// checkShards fails t when a shard's map, policy and cost disagree, or the
+// shard holds more than its capacity.
+func checkShards[K comparable, V any](t *testing.T, c *Cache[K, V]) {
+	t.Helper()
+	for i, s := range c.shards {
+		s.mu.Lock()
+		var cost int64
+		walked := 0
+		s.policy.walk(func(n *node[K, V]) {
+			walked++
+			cost += n.cost
+			if s.hash[n.key] != n {
+				t.Errorf("shard %d: policy holds %v, the map doesn't", i, n.key)
+			}
+		})
+		if walked != len(s.hash) || s.policy.len() != len(s.hash) {
+			t.Errorf("shard %d: policy walks %d and counts %d entries, the map has %d", i, walked, s.policy.len(), len(s.hash))
+		}
+		if cost != s.cost {
+			t.Errorf("shard %d: entries cost %d, the shard counts %d", i, cost, s.cost)
+		}
+		if s.cost > s.capacity {
+			t.Errorf("shard %d: cost %d over capacity %d", i, s.cost, s.capacity)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func TestGetPutDelete(t *testing.T) {
+	c := New(Options[string, int]{Capacity: 3})
+
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("Get on an empty cache found a")
+	}
+	c.Put("a", 1)
+	c.Put("b", 2)
+	if v, ok := c.Get("a"); !ok || v != 1 {
+		t.Fatalf("Get(a) = %d, %v, want 1, true", v, ok)
+	}
+	c.Put("a", 10)
+	if v, _ := c.Get("a"); v != 10 {
+		t.Fatalf("Get(a) after overwrite = %d, want 10", v)
+	}
+	if c.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", c.Len())
+	}
+
+	if !c.Delete("a") {
+		t.Fatal("Delete(a) = false, want true")
+	}
+	if c.Delete("a") {
+		t.Fatal("second Delete(a) = true, want false")
+	}
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("Get found a deleted key")
+	}
+	if c.Len() != 1 {
+		t.Fatalf("Len() = %d, want 1", c.Len())
+	}
+	checkShards(t, c)
+}
+
+func TestPeekDoesNotTouch(t *testing.T) {
+	c := New(Options[string, int]{Capacity: 2})
+	c.Put("a", 1)
+	c.Put("b", 2)
+
+	if v, ok := c.Peek("a"); !ok || v != 1 {
+		t.Fatalf("Peek(a) = %d, %v, want 1, true", v, ok)
+	}
+	// a is still the least recently used
+	c.Put("c", 3)
+	if _, ok := c.Peek("a"); ok {
+		t.Fatal("a survived, Peek counted as an access")
+	}
+	if _, ok := c.Peek("b"); !ok {
+		t.Fatal("b was evicted instead of a")
+	}
+}
+
+func TestKeysOrder(t *testing.T) {
+	c := New(Options[string, int]{Capacity: 4})
+	for i, k := range []string{"a", "b", "c", "d"} {
+		c.Put(k, i)
+	}
+	c.Get("b")
+	c.Put("a", 0)
+
+	want := []string{"a", "b", "d", "c"}
+	if got := c.Keys(); !slices.Equal(got, want) {
+		t.Fatalf("Keys() = %v, want %v", got, want)
+	}
+}
+
+func TestEvictsLeastRecentlyUsed(t *testing.T) {
+	var evicted []string
+	c := New(Options[string, int]{
+		Capacity: 3,
+		OnEvict: func(key string, value int, reason EvictionReason) {
+			if reason != ReasonCapacity {
+				t.Errorf("%s evicted for %v, want capacity", key, reason)
+			}
+			evicted = append(evicted, key)
+		},
+	})
+	c.Put("a", 1)
+	c.Put("b", 2)
+	c.Put("c", 3)
+	c.Get("a")
+	c.Put("d", 4)
+	c.Put("e", 5)
+
+	if want := []string{"b", "c"}; !slices.Equal(evicted, want) {
+		t.Fatalf("evicted %v, want %v", evicted, want)
+	}
+	if want := []string{"e", "d", "a"}; !slices.Equal(c.Keys(), want) {
+		t.Fatalf("Keys() = %v, want %v", c.Keys(), want)
+	}
+	checkShards(t, c)
+}
+
+func TestCapacityHoldsForEveryPolicy(t *testing.T) {
+	for _, policy := range policies {
+		t.Run(policy.String(), func(t *testing.T) {
+			c := New(Options[int, int]{Capacity: 100, Policy: policy})
+			r := rand.New(rand.NewSource(1))
+			for i := 0; i < 20000; i++ {
+				// a skewed workload, so the policies' ghosts and
+				// frequencies come into play
+				key := int(r.ExpFloat64() * 100)
+				if _, ok := c.Get(key); !ok {
+					c.Put(key, i)
+				}
+				if i%1000 == 0 {
+					checkShards(t, c)
+				}
+			}
+			if c.Len() != 100 {
+				t.Fatalf("Len() = %d, want 100", c.Len())
+			}
+			checkShards(t, c)
+		})
+	}
+}
+
+func TestShardedCapacitySplit(t *testing.T) {
+	c := New(Options[int, int]{Capacity: 10, Shards: 4})
+	if len(c.shards) != 4 {
+		t.Fatalf("%d shards, want 4", len(c.shards))
+	}
+	var capacities []int64
+	for _, s := range c.shards {
+		capacities = append(capacities, s.capacity)
+	}
+	if want := []int64{3, 3, 2, 2}; !slices.Equal(capacities, want) {
+		t.Fatalf("shard capacities %v, want %v", capacities, want)
+	}
+
+	for i := 0; i < 1000; i++ {
+		c.Put(i, i)
+	}
+	if c.Len() != 10 {
+		t.Fatalf("Len() = %d, want 10", c.Len())
+	}
+	checkShards(t, c)
+
+	// every shard holds at least one entry
+	if c := New(Options[int, int]{Capacity: 3, Shards: 8}); len(c.shards) != 3 {
+		t.Fatalf("%d shards for a capacity of 3, want 3", len(c.shards))
+	}
+}
+
+func TestCost(t *testing.T) {
+	c := New(Options[string, string]{
+		Capacity: 10,
+		Cost:     func(key string, value string) int64 { return int64(len(value)) },
+	})
+	c.Put("a", "xxxx")
+	c.Put("b", "xxxx")
+	c.Put("c", "xxxx")
+	if _, ok := c.Peek("a"); ok {
+		t.Fatal("a survived, the cache holds 12 of 10")
+	}
+	if c.Cost() != 8 {
+		t.Fatalf("Cost() = %d, want 8", c.Cost())
+	}
+
+	// an entry costing more than the capacity isn't stored, and takes the
+	// old value along
+	c.Put("b", "xxxxxxxxxxx")
+	if _, ok := c.Peek("b"); ok {
+		t.Fatal("b is stored at a cost over the capacity")
+	}
+	if c.Cost() != 4 {
+		t.Fatalf("Cost() = %d, want 4", c.Cost())
+	}
+	checkShards(t, c)
+}
+
+func TestConcurrentUse(t *testing.T) {
+	for _, policy := range policies {
+		t.Run(policy.String(), func(t *testing.T) {
+			c := New(Options[string, int]{Capacity: 64, Shards: 4, Policy: policy})
+			var wg sync.WaitGroup
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					r := rand.New(rand.NewSource(int64(g)))
+					for i := 0; i < 5000; i++ {
+						key := fmt.Sprint(r.Intn(200))
+						switch r.Intn(10) {
+						case 0:
+							c.Delete(key)
+						case 1:
+							c.Peek(key)
+						case 2:
+							c.Keys()
+							c.Len()
+						case 3, 4, 5:
+							c.Put(key, i)
+						default:
+							c.Get(key)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			if c.Len() > 64 {
+				t.Fatalf("Len() = %d over the capacity of 64", c.Len())
+			}
+			checkShards(t, c)
+		})
+	}
+}
+
+// clock is a time the tests move on by hand.
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newClock() *clock {
+	return &clock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestTTLExpiry(t *testing.T) {
+	clk := newClock()
+	c := New(Options[string, int]{Capacity: 10, TTL: time.Minute, now: clk.Now})
+	c.Put("get", 1)
+	c.Put("peek", 2)
+	c.PutWithTTL("forever", 3, 0)
+	c.PutWithTTL("long", 4, time.Hour)
+
+	clk.Advance(59 * time.Second)
+	if _, ok := c.Get("get"); !ok {
+		t.Fatal("Get missed an entry before its TTL ran out")
+	}
+	if _, ok := c.Peek("peek"); !ok {
+		t.Fatal("Peek missed an entry before its TTL ran out")
+	}
+	if ttl, _ := c.TTL("get"); ttl != time.Second {
+		t.Fatalf("TTL(get) = %v, want 1s", ttl)
+	}
+
+	clk.Advance(time.Second)
+	if _, ok := c.Get("get"); ok {
+		t.Fatal("Get found an expired entry")
+	}
+	if _, ok := c.Peek("peek"); ok {
+		t.Fatal("Peek found an expired entry")
+	}
+	if c.Len() != 2 {
+		t.Fatalf("Len() = %d, want the expired entries removed on lookup", c.Len())
+	}
+	if ttl, ok := c.TTL("long"); !ok || ttl != time.Hour-time.Minute {
+		t.Fatalf("TTL(long) = %v, %v, want its own TTL left", ttl, ok)
+	}
+
+	clk.Advance(365 * 24 * time.Hour)
+	if v, ok := c.Get("forever"); !ok || v != 3 {
+		t.Fatalf("Get(forever) = %d, %v, want an entry stored with TTL 0 to stay", v, ok)
+	}
+	if ttl, ok := c.TTL("forever"); !ok || ttl != 0 {
+		t.Fatalf("TTL(forever) = %v, %v, want 0, true", ttl, ok)
+	}
+	if keys := c.Keys(); !slices.Equal(keys, []string{"forever"}) {
+		t.Fatalf("Keys() = %v, want only the entry that doesn't expire", keys)
+	}
+	if s := c.Stats(); s.Expirations != 2 {
+		t.Fatalf("%d expirations counted, want 2", s.Expirations)
+	}
+}
+
+func TestCleanupSweeps(t *testing.T) {
+	clk := newClock()
+	evicted := make(chan string, 10)
+	c := New(Options[string, int]{
+		Capacity:        10,
+		TTL:             time.Minute,
+		CleanupInterval: time.Millisecond,
+		OnEvict: func(key string, value int, reason EvictionReason) {
+			if reason != ReasonExpired {
+				t.Errorf("%s swept as %v, want %v", key, reason, ReasonExpired)
+			}
+			evicted <- key
+		},
+		now: clk.Now,
+	})
+	defer c.Close()
+	c.Put("a", 1)
+	c.PutWithTTL("b", 2, 0)
+
+	clk.Advance(2 * time.Minute)
+	select {
+	case key := <-evicted:
+		if key != "a" {
+			t.Fatalf("swept %s, want a", key)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the expired entry wasn't swept")
+	}
+	// nothing looked a up, the sweep removed it
+	if c.Len() != 1 {
+		t.Fatalf("Len() = %d after the sweep, want 1", c.Len())
+	}
+	if s := c.Stats(); s.Expirations != 1 {
+		t.Fatalf("%d expirations counted, want 1", s.Expirations)
+	}
+}
+
+func TestCloseStopsCleanup(t *testing.T) {
+	c := New(Options[string, int]{Capacity: 10, CleanupInterval: time.Millisecond})
+	c.Close()
+	select {
+	case <-c.stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the cleanup goroutine is still running after Close")
+	}
+	c.Close()
+
+	// the cache stays usable
+	c.Put("a", 1)
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("Get after Close missed")
+	}
+}
+
+func TestOnEvictReasons(t *testing.T) {
+	type evictedEntry struct {
+		key    string
+		reason EvictionReason
+	}
+	clk := newClock()
+	var evicted []evictedEntry
+	var c *Cache[string, int]
+	c = New(Options[string, int]{
+		Capacity: 2,
+		OnEvict: func(key string, value int, reason EvictionReason) {
+			if !c.shards[0].mu.TryLock() {
+				t.Errorf("OnEvict for %s called with the lock held", key)
+				return
+			}
+			c.shards[0].mu.Unlock()
+			evicted = append(evicted, evictedEntry{key, reason})
+		},
+		now: clk.Now,
+	})
+
+	c.Put("a", 1)
+	c.Put("b", 2)
+	c.Put("c", 3) // evicts a
+	c.Delete("b")
+	c.PutWithTTL("d", 4, time.Second)
+	clk.Advance(2 * time.Second)
+	c.Get("d")
+	c.PutWithTTL("e", 5, time.Second)
+	clk.Advance(2 * time.Second)
+	c.Delete("e") // expired before the Delete
+	c.PutWithTTL("f", 6, time.Second)
+	clk.Advance(2 * time.Second)
+	c.Put("g", 7) // evicts c, the least recently used
+	c.Put("h", 8) // evicts f, which has expired meanwhile
+	c.Put("a", 9)
+	c.Put("a", 10) // overwritten, not evicted
+
+	want := []evictedEntry{
+		{"a", ReasonCapacity},
+		{"b", ReasonDeleted},
+		{"d", ReasonExpired},
+		{"e", ReasonExpired},
+		{"c", ReasonCapacity},
+		{"f", ReasonExpired},
+		{"g", ReasonCapacity},
+	}
+	if !slices.Equal(evicted, want) {
+		t.Fatalf("evicted %v, want %v", evicted, want)
+	}
+}
+
+func TestOnEvictTooCostlyUpdate(t *testing.T) {
+	type evictedEntry struct {
+		key    string
+		value  string
+		reason EvictionReason
+	}
+	var evicted []evictedEntry
+	c := New(Options[string, string]{
+		Capacity: 4,
+		Cost:     func(key string, value string) int64 { return int64(len(value)) },
+		OnEvict: func(key string, value string, reason EvictionReason) {
+			evicted = append(evicted, evictedEntry{key, value, reason})
+		},
+	})
+	c.Put("a", "xx")
+	c.Put("a", "xxxxx")
+
+	// the old value and the one that doesn't fit both leave
+	want := []evictedEntry{{"a", "xx", ReasonCapacity}, {"a", "xxxxx", ReasonCapacity}}
+	if !slices.Equal(evicted, want) {
+		t.Fatalf("evicted %v, want %v", evicted, want)
+	}
+	if s := c.Stats(); s.Evictions != 2 {
+		t.Fatalf("%d evictions counted, want 2", s.Evictions)
+	}
+	checkShards(t, c)
+}
+
+func TestLFUEvictsLeastFrequentlyUsed(t *testing.T) {
+	c := New(Options[string, int]{Capacity: 3, Policy: LFU})
+	c.Put("a", 1)
+	c.Put("b", 2)
+	c.Put("c", 3)
+	c.Get("a")
+	c.Get("a")
+	c.Get("b")
+
+	// deleting the only entry of the lowest count leaves b's lowest
+	c.Delete("c")
+	c.Put("d", 4)
+	c.Put("e", 5) // evicts d, used once like e but longer ago
+	if keys := c.Keys(); !slices.Equal(keys, []string{"a", "b", "e"}) {
+		t.Fatalf("Keys() = %v, want [a b e]", keys)
+	}
+	c.Delete("e")
+	c.Delete("b")
+	c.Put("f", 6)
+	c.Put("g", 7)
+	c.Put("h", 8) // evicts f
+	if keys := c.Keys(); !slices.Equal(keys, []string{"a", "h", "g"}) {
+		t.Fatalf("Keys() = %v, want [a h g]", keys)
+	}
+	checkShards(t, c)
+}
@@ -0,0 +1,114 @@
+package cache
+
+// lfu keeps a queue per access count and links the counts in use in
+// ascending order, so finding the least frequently used entry and moving an
+// entry on to the next count take constant time. Within a count the queue
+// orders by recency.
+type lfu[K comparable, V any] struct {
+	buckets map[int]*bucket[K, V] // only counts that have entries
+	lowest  *bucket[K, V]
+	highest *bucket[K, V]
+	length  int
+}
+
+// bucket holds the entries accessed count times, between the buckets of the
+// next lower and the next higher count in use.
+type bucket[K comparable, V any] struct {
+	queue[K, V]
+	count  int
+	lower  *bucket[K, V]
+	higher *bucket[K, V]
+}
+
+func newLFU[K comparable, V any]() *lfu[K, V] {
+	return &lfu[K, V]{buckets: map[int]*bucket[K, V]{}}
+}
+
+func (l *lfu[K, V]) add(n *node[K, V]) {
+	n.freq = 1
+	l.bucketAfter(nil, 1).pushFront(n)
+	l.length++
+}
+
+func (l *lfu[K, V]) hit(n *node[K, V]) {
+	b := l.buckets[n.freq]
+	n.freq++
+	// linked in before b can go
+	next := l.bucketAfter(b, n.freq)
+	b.remove(n)
+	l.dropEmpty(b)
+	next.pushFront(n)
+}
+
+func (l *lfu[K, V]) remove(n *node[K, V]) {
+	b := l.buckets[n.freq]
+	b.remove(n)
+	l.dropEmpty(b)
+	l.length--
+}
+
+func (l *lfu[K, V]) resize(n *node[K, V], cost int64) {
+	l.buckets[n.freq].resize(n, cost)
+}
+
+func (l *lfu[K, V]) evict(incoming K) *node[K, V] {
+	if l.lowest == nil {
+		return nil
+	}
+	n := l.lowest.back()
+	l.remove(n)
+	return n
+}
+
+func (l *lfu[K, V]) walk(f func(n *node[K, V])) {
+	for b := l.highest; b != nil; b = b.lower {
+		b.walk(f)
+	}
+}
+
+func (l *lfu[K, V]) len() int { return l.length }
+
+// bucketAfter returns the bucket of count, which comes right after prev in
+// the order of counts, or first when prev is nil. The bucket is created when
+// the count isn't in use yet.
+func (l *lfu[K, V]) bucketAfter(prev *bucket[K, V], count int) *bucket[K, V] {
+	next := l.lowest
+	if prev != nil {
+		next = prev.higher
+	}
+	if next != nil && next.count == count {
+		return next
+	}
+
+	b := &bucket[K, V]{queue: newQueue[K, V](), count: count, lower: prev, higher: next}
+	if prev != nil {
+		prev.higher = b
+	} else {
+		l.lowest = b
+	}
+	if next != nil {
+		next.lower = b
+	} else {
+		l.highest = b
+	}
+	l.buckets[count] = b
+	return b
+}
+
+// dropEmpty unlinks b once its last entry is gone.
+func (l *lfu[K, V]) dropEmpty(b *bucket[K, V]) {
+	if b.length > 0 {
+		return
+	}
+	if b.lower != nil {
+		b.lower.higher = b.higher
+	} else {
+		l.lowest = b.higher
+	}
+	if b.higher != nil {
+		b.higher.lower = b.lower
+	} else {
+		l.highest = b.lower
+	}
+	delete(l.buckets, b.count)
+}
@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"errors"
+	"time"
+)
+
+var errLoaderPanicked = errors.New("cache: loader panicked")
+
+// call is a load in flight, the callers wanting the same key wait for it
+// instead of loading it again.
+type call[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// failure is a failed load, remembered so a broken backend isn't asked
+// again for every request.
+type failure struct {
+	err     error
+	expires int64 // unix nanoseconds
+}
+
+// GetOrLoad returns the value of key, calling loader to get and store it
+// when it isn't in the cache. Concurrent calls for a missing key share one
+// loader call. A loader error is returned to all of them and, with
+// ErrorTTL set, to the calls for key that follow within ErrorTTL. A loader
+// panic goes on in the call that ran the loader, the others get an error;
+// a refresh that panics is dropped.
+func (c *Cache[K, V]) GetOrLoad(key K, loader func(key K) (V, error)) (V, error) {
+	if value, expires, ok := c.lookup(key, true); ok {
+		if c.refreshAhead > 0 && expires != 0 && time.Unix(0, expires).Sub(c.now()) < c.refreshAhead {
+			if l, started := c.begin(key); started {
+				go func() {
+					// nobody could recover the panic of a refresh, it's
+					// dropped like a failed one
+					defer func() { recover() }()
+					c.load(key, loader, l, true)
+				}()
+			}
+		}
+		return value, nil
+	}
+
+	if err := c.failed(key); err != nil {
+		var zero V
+		return zero, err
+	}
+	l, started := c.begin(key)
+	if started {
+		c.load(key, loader, l, false)
+	} else {
+		<-l.done
+	}
+	return l.value, l.err
+}
+
+// begin returns the load in flight for key, started reports whether the
+// caller has to run it.
+func (c *Cache[K, V]) begin(key K) (l *call[V], started bool) {
+	c.loadMu.Lock()
+	defer c.loadMu.Unlock()
+
+	if l, ok := c.loads[key]; ok {
+		return l, false
+	}
+	l = &call[V]{done: make(chan struct{})}
+	c.loads[key] = l
+	return l, true
+}
+
+// load runs loader for the callers waiting on l and stores what it
+// returns. A failed refresh isn't remembered, the value it was to replace
+// is still good until it expires.
+func (c *Cache[K, V]) load(key K, loader func(key K) (V, error), l *call[V], refresh bool) {
+	panicked := true
+	defer func() {
+		if panicked {
+			// the waiting callers get an error, the panic goes on in this one
+			l.err = errLoaderPanicked
+		}
+		c.loadMu.Lock()
+		delete(c.loads, key)
+		if l.err != nil && !panicked && !refresh && c.errorTTL > 0 {
+			c.failures[key] = failure{err: l.err, expires: c.now().Add(c.errorTTL).UnixNano()}
+		}
+		c.loadMu.Unlock()
+		close(l.done)
+	}()
+
+	c.loaded.Add(1)
+	l.value, l.err = loader(key)
+	if l.err != nil {
+		c.loadFailed.Add(1)
+	} else {
+		// stored before the call ends, so a caller that comes after it finds
+		// the value
+		c.Put(key, l.value)
+	}
+	panicked = false
+}
+
+// failed returns the error of a failed load of key that is still
+// remembered.
+func (c *Cache[K, V]) failed(key K) error {
+	c.loadMu.Lock()
+	defer c.loadMu.Unlock()
+
+	f, ok := c.failures[key]
+	if !ok {
+		return nil
+	}
+	if c.now().UnixNano() >= f.expires {
+		delete(c.failures, key)
+		return nil
+	}
+	return f.err
+}
+
+// forgetFailures drops the failures that have expired, the ones never asked
+// for again would stay forever otherwise.
+func (c *Cache[K, V]) forgetFailures(now int64) {
+	c.loadMu.Lock()
+	defer c.loadMu.Unlock()
+
+	for key, f := range c.failures {
+		if now >= f.expires {
+			delete(c.failures, key)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetOrLoadSharesOneLoad(t *testing.T) {
+	c := New(Options[string, int]{Capacity: 10})
+	var calls atomic.Int32
+	release := make(chan struct{})
+	loader := func(key string) (int, error) {
+		calls.Add(1)
+		<-release
+		return 42, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]int, 10)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.GetOrLoad("a", loader)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = v
+		}()
+	}
+	// let the callers pile up behind the first load
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("loader called %d times, want 1", n)
+	}
+	for i, v := range results {
+		if v != 42 {
+			t.Fatalf("caller %d got %d, want 42", i, v)
+		}
+	}
+	if v, ok := c.Peek("a"); !ok || v != 42 {
+		t.Fatalf("Peek(a) = %d, %v, want the loaded 42", v, ok)
+	}
+}
+
+func TestGetOrLoadRemembersFailures(t *testing.T) {
+	c := New(Options[string, int]{Capacity: 10, ErrorTTL: 50 * time.Millisecond})
+	errDown := errors.New("backend down")
+	calls := 0
+	loader := func(key string) (int, error) {
+		calls++
+		if calls == 1 {
+			return 0, errDown
+		}
+		return 7, nil
+	}
+
+	if _, err := c.GetOrLoad("a", loader); !errors.Is(err, errDown) {
+		t.Fatalf("first GetOrLoad err = %v, want %v", err, errDown)
+	}
+	if _, err := c.GetOrLoad("a", loader); !errors.Is(err, errDown) {
+		t.Fatalf("GetOrLoad within ErrorTTL err = %v, want %v", err, errDown)
+	}
+	if calls != 1 {
+		t.Fatalf("loader called %d times within ErrorTTL, want 1", calls)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if v, err := c.GetOrLoad("a", loader); err != nil || v != 7 {
+		t.Fatalf("GetOrLoad after ErrorTTL = %d, %v, want 7, nil", v, err)
+	}
+}
+
+func TestGetOrLoadRefreshesAhead(t *testing.T) {
+	c := New(Options[string, int]{Capacity: 10, TTL: 200 * time.Millisecond, RefreshAhead: 150 * time.Millisecond})
+	refreshed := make(chan struct{})
+	c.Put("a", 1)
+	loader := func(key string) (int, error) {
+		defer close(refreshed)
+		return 2, nil
+	}
+
+	// not expiring soon yet
+	if v, _ := c.GetOrLoad("a", loader); v != 1 {
+		t.Fatalf("GetOrLoad = %d, want 1", v)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// the current value is returned while the refresh runs
+	if v, _ := c.GetOrLoad("a", loader); v != 1 {
+		t.Fatalf("GetOrLoad during the refresh = %d, want 1", v)
+	}
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatal("no refresh")
+	}
+	// the refresh stores the value before its call ends
+	deadline := time.Now().Add(time.Second)
+	for {
+		if v, _ := c.Peek("a"); v == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("refreshed value not stored")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if ttl, _ := c.TTL("a"); ttl < 150*time.Millisecond {
+		t.Fatalf("TTL after the refresh = %v, want a new lifetime", ttl)
+	}
+}
+
+func TestGetOrLoadPanickingRefreshIsDropped(t *testing.T) {
+	c := New(Options[string, int]{Capacity: 10, TTL: time.Minute, RefreshAhead: 2 * time.Minute})
+	c.Put("a", 1)
+	panicked := make(chan struct{})
+	loader := func(key string) (int, error) {
+		close(panicked)
+		panic("loader broke")
+	}
+
+	if v, err := c.GetOrLoad("a", loader); err != nil || v != 1 {
+		t.Fatalf("GetOrLoad = %d, %v, want 1, nil", v, err)
+	}
+	<-panicked
+	// the refresh is forgotten, so the next one can start
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.loadMu.Lock()
+		_, inFlight := c.loads["a"]
+		c.loadMu.Unlock()
+		if !inFlight {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("panicked refresh still in flight")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if v, ok := c.Peek("a"); !ok || v != 1 {
+		t.Fatalf("Peek(a) = %d, %v, want the old 1", v, ok)
+	}
+}
+
+func TestGetOrLoadPanicReachesTheLoadingCaller(t *testing.T) {
+	c := New(Options[string, int]{Capacity: 10, ErrorTTL: time.Minute})
+	started := make(chan struct{})
+	release := make(chan struct{})
+	loader := func(key string) (int, error) {
+		close(started)
+		<-release
+		panic("loader broke")
+	}
+
+	recovered := make(chan any)
+	go func() {
+		defer func() { recovered <- recover() }()
+		c.GetOrLoad("a", loader)
+	}()
+	<-started
+	waiter := make(chan error)
+	go func() {
+		_, err := c.GetOrLoad("a", loader)
+		waiter <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	if r := <-recovered; r == nil {
+		t.Fatal("the loading caller didn't panic")
+	}
+	if err := <-waiter; !errors.Is(err, errLoaderPanicked) {
+		t.Fatalf("waiting caller err = %v, want %v", err, errLoaderPanicked)
+	}
+	// a panic isn't remembered as a failure
+	if v, err := c.GetOrLoad("a", func(string) (int, error) { return 3, nil }); err != nil || v != 3 {
+		t.Fatalf("GetOrLoad after the panic = %d, %v, want 3, nil", v, err)
+	}
+}
@@ -0,0 +1,143 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Policy chooses which entry a full cache evicts.
+type Policy int
+
+const (
+	// LRU evicts the least recently used entry.
+	LRU Policy = iota
+	// LFU evicts the least frequently used entry, the least recently used
+	// one among equals.
+	LFU
+	// TwoQueue keeps entries seen once in a FIFO queue and only promotes
+	// them to the LRU queue when they come back, so a scan can't flush the
+	// entries in use.
+	TwoQueue
+	// ARC balances a recency and a frequency queue, adapting their sizes to
+	// the workload by remembering recently evicted keys.
+	ARC
+	// TinyLFU is W-TinyLFU: new entries go through a small LRU window and are
+	// only admitted to the main cache when a frequency sketch estimates them
+	// to be used more often than the entry they would replace.
+	TinyLFU
+)
+
+var policyNames = []string{LRU: "lru", LFU: "lfu", TwoQueue: "2q", ARC: "arc", TinyLFU: "tinylfu"}
+
+func (p Policy) String() string {
+	if p < 0 || int(p) >= len(policyNames) {
+		return fmt.Sprintf("Policy(%d)", int(p))
+	}
+	return policyNames[p]
+}
+
+// ParsePolicy returns the policy of a name as printed by String.
+func ParsePolicy(name string) (Policy, error) {
+	for p, n := range policyNames {
+		if strings.EqualFold(name, n) {
+			return Policy(p), nil
+		}
+	}
+	return 0, fmt.Errorf("cache: unknown policy %q", name)
+}
+
+// policy orders the entries of a shard. The shard keeps the hash and the
+// total cost, it calls evict until there is room before it adds a node.
+type policy[K comparable, V any] interface {
+	// add takes in a node that isn't in the cache yet.
+	add(n *node[K, V])
+	// hit records an access to n.
+	hit(n *node[K, V])
+	// remove drops n, e.g. when it was deleted or expired.
+	remove(n *node[K, V])
+	// resize changes the cost of n when its value was overwritten.
+	resize(n *node[K, V], cost int64)
+	// evict unlinks and returns the entry to give up to make room for
+	// incoming, nil when the policy holds no entries.
+	evict(incoming K) *node[K, V]
+	// walk calls f for every node, the most valuable ones first.
+	walk(f func(n *node[K, V]))
+	len() int
+}
+
+// newPolicy returns p for a shard of capacity, which is a cost.
+func newPolicy[K comparable, V any](p Policy, capacity int64, hash func(key K) uint64) policy[K, V] {
+	switch p {
+	case LFU:
+		return newLFU[K, V]()
+	case TwoQueue:
+		return newTwoQueue[K, V](capacity)
+	case ARC:
+		return newARC[K, V](capacity)
+	case TinyLFU:
+		return newTinyLFU[K, V](capacity, hash)
+	}
+	return &lru[K, V]{queue: newQueue[K, V]()}
+}
+
+// lru is the plain least recently used policy over one queue.
+type lru[K comparable, V any] struct {
+	queue queue[K, V]
+}
+
+func (l *lru[K, V]) add(n *node[K, V])    { l.queue.pushFront(n) }
+func (l *lru[K, V]) hit(n *node[K, V])    { l.queue.moveToFront(n) }
+func (l *lru[K, V]) remove(n *node[K, V]) { l.queue.remove(n) }
+func (l *lru[K, V]) len() int             { return l.queue.length }
+
+func (l *lru[K, V]) resize(n *node[K, V], cost int64) { l.queue.resize(n, cost) }
+
+func (l *lru[K, V]) evict(incoming K) *node[K, V] {
+	n := l.queue.back()
+	if n != nil {
+		l.queue.remove(n)
+	}
+	return n
+}
+
+func (l *lru[K, V]) walk(f func(n *node[K, V])) {
+	l.queue.walk(f)
+}
+
+// ghost remembers the keys and costs of recently evicted entries, oldest
+// first out, up to a total cost of capacity.
+type ghost[K comparable, V any] struct {
+	queue    queue[K, V]
+	hash     hash[K, V]
+	capacity int64
+}
+
+func newGhost[K comparable, V any](capacity int64) ghost[K, V] {
+	return ghost[K, V]{queue: newQueue[K, V](), hash: hash[K, V]{}, capacity: capacity}
+}
+
+func (g *ghost[K, V]) add(evicted *node[K, V]) {
+	n := &node[K, V]{key: evicted.key, cost: evicted.cost}
+	g.queue.pushFront(n)
+	g.hash[n.key] = n
+	g.trim(g.capacity)
+}
+
+// remove forgets key and reports whether it was remembered.
+func (g *ghost[K, V]) remove(key K) bool {
+	n, ok := g.hash[key]
+	if ok {
+		g.queue.remove(n)
+		delete(g.hash, key)
+	}
+	return ok
+}
+
+// trim forgets the oldest keys until they cost at most size.
+func (g *ghost[K, V]) trim(size int64) {
+	for g.queue.length > 0 && g.queue.cost > size {
+		n := g.queue.back()
+		g.queue.remove(n)
+		delete(g.hash, n.key)
+	}
+}
@@ -0,0 +1,91 @@
+package cache
+
+// node is one entry of the cache, linked into a queue by its neighbours.
+type node[K comparable, V any] struct {
+	key     K
+	value   V
+	expires int64 // unix nanoseconds, 0 when the entry doesn't expire
+	cost    int64
+	freq    int   // accesses, counted by LFU
+	list    uint8 // the queue of its policy the node is in
+	right   *node[K, V]
+	left    *node[K, V]
+}
+
+func (n *node[K, V]) expired(now int64) bool {
+	return n.expires != 0 && now >= n.expires
+}
+
+// queue is a doubly linked list between two empty sentinel nodes. The most
+// recently used entry sits right of head, the least recently used one left
+// of tail.
+type queue[K comparable, V any] struct {
+	head   *node[K, V]
+	tail   *node[K, V]
+	length int
+	cost   int64 // of all nodes
+}
+
+// hash finds the node of a key.
+type hash[K comparable, V any] map[K]*node[K, V]
+
+func newQueue[K comparable, V any]() queue[K, V] {
+	head := &node[K, V]{} // empty node first reference
+	tail := &node[K, V]{} // empty node last reference
+
+	head.right = tail
+	tail.left = head
+
+	return queue[K, V]{head: head, tail: tail}
+}
+
+// pushFront links n in right after head.
+func (q *queue[K, V]) pushFront(n *node[K, V]) {
+	temp := q.head.right
+
+	q.head.right = n
+	n.left = q.head
+	n.right = temp
+	temp.left = n
+
+	q.length++
+	q.cost += n.cost
+}
+
+// remove unlinks n, which must be in q.
+func (q *queue[K, V]) remove(n *node[K, V]) {
+	left := n.left
+	right := n.right
+
+	left.right = right
+	right.left = left
+	n.left, n.right = nil, nil
+	q.length--
+	q.cost -= n.cost
+}
+
+// resize changes the cost of n, which is in q.
+func (q *queue[K, V]) resize(n *node[K, V], cost int64) {
+	q.cost += cost - n.cost
+	n.cost = cost
+}
+
+func (q *queue[K, V]) moveToFront(n *node[K, V]) {
+	q.remove(n)
+	q.pushFront(n)
+}
+
+// back is the least recently used node, nil when q is empty.
+func (q *queue[K, V]) back() *node[K, V] {
+	if q.length == 0 {
+		return nil
+	}
+	return q.tail.left
+}
+
+// walk calls f from the front to the back, f may not change q.
+func (q *queue[K, V]) walk(f func(n *node[K, V])) {
+	for n := q.head.right; n != q.tail; n = n.right {
+		f(n)
+	}
+}
@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotVersion is written first, Load refuses snapshots of another
+// version.
+const snapshotVersion = 1
+
+type snapshotHeader struct {
+	Version int
+	Entries int
+}
+
+type snapshotEntry[K comparable, V any] struct {
+	Key     K
+	Value   V
+	Expires int64 // unix nanoseconds, 0 when the entry doesn't expire
+}
+
+// Save writes the entries of the cache to w with encoding/gob, so K and V
+// must be types gob can encode. They are written from the most to the least
+// valuable, taking turns between the shards, which is the order Load
+// restores. Expired entries are left out.
+func (c *Cache[K, V]) Save(w io.Writer) error {
+	now := c.now().UnixNano()
+	shards := make([][]snapshotEntry[K, V], len(c.shards))
+	total := 0
+	for i, s := range c.shards {
+		s.mu.Lock()
+		s.policy.walk(func(n *node[K, V]) {
+			if !n.expired(now) {
+				shards[i] = append(shards[i], snapshotEntry[K, V]{Key: n.key, Value: n.value, Expires: n.expires})
+			}
+		})
+		s.mu.Unlock()
+		total += len(shards[i])
+	}
+
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(snapshotHeader{Version: snapshotVersion, Entries: total}); err != nil {
+		return fmt.Errorf("cache: save snapshot: %w", err)
+	}
+	for rank := 0; total > 0; rank++ {
+		for _, entries := range shards {
+			if rank >= len(entries) {
+				continue
+			}
+			if err := enc.Encode(entries[rank]); err != nil {
+				return fmt.Errorf("cache: save snapshot: %w", err)
+			}
+			total--
+		}
+	}
+	return nil
+}
+
+// Load adds the entries of a snapshot written by Save, each with the TTL it
+// had left; entries that expired since are skipped. The least valuable
+// entries are added first, so the LRU order comes back as it was saved.
+// The other policies start their bookkeeping over. Nothing is added when
+// the snapshot can't be read completely.
+func (c *Cache[K, V]) Load(r io.Reader) error {
+	dec := gob.NewDecoder(r)
+	var header snapshotHeader
+	if err := dec.Decode(&header); err != nil {
+		return fmt.Errorf("cache: load snapshot: %w", err)
+	}
+	if header.Version != snapshotVersion {
+		return fmt.Errorf("cache: load snapshot: unsupported version %d", header.Version)
+	}
+
+	// the count comes from the file, it mustn't allocate whatever it says
+	entries := make([]snapshotEntry[K, V], 0, min(max(header.Entries, 0), 1<<16))
+	for range header.Entries {
+		var e snapshotEntry[K, V]
+		if err := dec.Decode(&e); err != nil {
+			return fmt.Errorf("cache: load snapshot: %w", err)
+		}
+		entries = append(entries, e)
+	}
+
+	now := c.now()
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		var ttl time.Duration
+		if e.Expires != 0 {
+			if ttl = time.Unix(0, e.Expires).Sub(now); ttl <= 0 {
+				continue
+			}
+		}
+		c.PutWithTTL(e.Key, e.Value, ttl)
+	}
+	return nil
+}
+
+// SaveFile saves a snapshot to path. It writes a temporary file next to it
+// first, so path holds either the previous snapshot or the new one even if
+// the process dies halfway.
+func (c *Cache[K, V]) SaveFile(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("cache: save snapshot: %w", err)
+	}
+	defer os.Remove(f.Name()) // fails once renamed
+
+	if err := c.Save(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("cache: save snapshot: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("cache: save snapshot: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("cache: save snapshot: %w", err)
+	}
+	return nil
+}
+
+// LoadFile loads a snapshot saved by SaveFile. A missing file is an error
+// matching os.ErrNotExist.
+func (c *Cache[K, V]) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("cache: load snapshot: %w", err)
+	}
+	defer f.Close()
+	return c.Load(f)
+}
@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	clk := newClock()
+	c := New(Options[string, int]{Capacity: 10, now: clk.Now})
+	c.PutWithTTL("a", 1, time.Minute)
+	c.PutWithTTL("b", 2, 0)
+	c.PutWithTTL("c", 3, time.Hour)
+	c.Put("d", 4)
+	c.Get("b")
+	c.PutWithTTL("gone", 5, time.Second)
+	want := c.Keys()
+
+	var snapshot bytes.Buffer
+	if err := c.Save(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	// loaded 10 seconds later, "gone" has expired by then
+	clk.Advance(10 * time.Second)
+	loaded := New(Options[string, int]{Capacity: 10, now: clk.Now})
+	if err := loaded.Load(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	want = slices.DeleteFunc(want, func(key string) bool { return key == "gone" })
+	if keys := loaded.Keys(); !slices.Equal(keys, want) {
+		t.Fatalf("loaded keys %v, want %v in the saved order", keys, want)
+	}
+	for key, ttl := range map[string]time.Duration{"a": 50 * time.Second, "b": 0, "c": time.Hour - 10*time.Second, "d": 0} {
+		if got, ok := loaded.TTL(key); !ok || got != ttl {
+			t.Errorf("TTL(%s) = %v, %v, want %v left", key, got, ok, ttl)
+		}
+	}
+	if v, _ := loaded.Peek("c"); v != 3 {
+		t.Fatalf("Peek(c) = %d, want 3", v)
+	}
+}
+
+func TestSnapshotLeavesOutExpired(t *testing.T) {
+	clk := newClock()
+	c := New(Options[string, int]{Capacity: 10, now: clk.Now})
+	c.PutWithTTL("a", 1, time.Second)
+	c.PutWithTTL("b", 2, time.Minute)
+	clk.Advance(2 * time.Second)
+
+	var snapshot bytes.Buffer
+	if err := c.Save(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	loaded := New(Options[string, int]{Capacity: 10, now: clk.Now})
+	if err := loaded.Load(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if keys := loaded.Keys(); !slices.Equal(keys, []string{"b"}) {
+		t.Fatalf("loaded keys %v, want [b]", keys)
+	}
+}
+
+func TestSnapshotFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+	c := New(Options[string, int]{Capacity: 10})
+	if err := c.LoadFile(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("LoadFile of a missing file: %v, want %v", err, os.ErrNotExist)
+	}
+
+	c.Put("a", 1)
+	c.Put("b", 2)
+	if err := c.SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded := New(Options[string, int]{Capacity: 10})
+	if err := loaded.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if keys := loaded.Keys(); !slices.Equal(keys, []string{"b", "a"}) {
+		t.Fatalf("loaded keys %v, want [b a]", keys)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Fatalf("%d files next to the snapshot, want no temporary one left", len(entries)-1)
+	}
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	c := New(Options[string, int]{Capacity: 10})
+	for i := range 5 {
+		c.Put(string(rune('a'+i)), i)
+	}
+	var snapshot bytes.Buffer
+	if err := c.Save(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	saved := snapshot.Bytes()
+
+	var otherVersion, missingEntries bytes.Buffer
+	gob.NewEncoder(&otherVersion).Encode(snapshotHeader{Version: snapshotVersion + 1})
+	gob.NewEncoder(&missingEntries).Encode(snapshotHeader{Version: snapshotVersion, Entries: 3})
+
+	for _, tc := range []struct {
+		name     string
+		snapshot []byte
+	}{
+		{"empty", nil},
+		{"garbage", []byte("not a snapshot")},
+		{"truncated", saved[:len(saved)-3]},
+		{"cut in the middle", saved[:len(saved)/3]},
+		{"entries missing", missingEntries.Bytes()},
+		{"other version", otherVersion.Bytes()},
+	} {
+		loaded := New(Options[string, int]{Capacity: 10})
+		loaded.Put("kept", 1)
+		if err := loaded.Load(bytes.NewReader(tc.snapshot)); err == nil {
+			t.Errorf("%s: Load succeeded", tc.name)
+		}
+		if keys := loaded.Keys(); !slices.Equal(keys, []string{"kept"}) {
+			t.Errorf("%s: keys %v after a failed Load, want only those before", tc.name, keys)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package cache
+
+// Stats counts what happened in a cache since it was created.
+type Stats struct {
+	Hits   uint64 // Get and GetOrLoad calls that found their key
+	Misses uint64 // Get and GetOrLoad calls that didn't
+	// Evictions are the entries evicted to make room, or not stored because
+	// they cost more than the capacity.
+	Evictions   uint64
+	Expirations uint64 // entries removed because their TTL ran out
+	Loads       uint64 // loader calls of GetOrLoad
+	LoadErrors  uint64 // loader calls that failed
+}
+
+// HitRatio is the share of lookups that hit, 0 when there were none.
+func (s Stats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// Stats returns the counters of the cache. Peek, TTL and the lookups of
+// Delete aren't counted as hits or misses.
+func (c *Cache[K, V]) Stats() Stats {
+	stats := Stats{
+		Evictions:   c.evictions.Load(),
+		Expirations: c.expirations.Load(),
+		Loads:       c.loaded.Load(),
+		LoadErrors:  c.loadFailed.Load(),
+	}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		stats.Hits += s.hits
+		stats.Misses += s.misses
+		s.mu.Unlock()
+	}
+	return stats
+}
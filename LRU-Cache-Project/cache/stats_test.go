@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	clk := newClock()
+	c := New(Options[string, int]{Capacity: 2, now: clk.Now})
+	if s := c.Stats(); s != (Stats{}) || s.HitRatio() != 0 {
+		t.Fatalf("Stats of a new cache = %+v, ratio %v, want zero", s, s.HitRatio())
+	}
+
+	c.Put("a", 1)
+	c.Get("a")  // hit
+	c.Get("a")  // hit
+	c.Get("b")  // miss
+	c.Peek("a") // not counted
+	c.TTL("b")  // not counted
+	c.Put("b", 2)
+	c.Put("c", 3)                     // evicts a
+	c.PutWithTTL("d", 4, time.Second) // evicts b
+	c.Put("e", 5)                     // evicts c
+	c.PutWithTTL("f", 6, time.Minute) // evicts d
+	clk.Advance(2 * time.Minute)
+	c.Get("f") // expired, a miss
+	c.Delete("e")
+
+	errLoad := errors.New("load failed")
+	c.GetOrLoad("x", func(string) (int, error) { return 0, errLoad }) // miss
+	c.GetOrLoad("y", func(string) (int, error) { return 1, nil })     // miss
+	c.GetOrLoad("y", func(string) (int, error) { return 2, nil })     // hit
+
+	want := Stats{Hits: 3, Misses: 4, Evictions: 4, Expirations: 1, Loads: 2, LoadErrors: 1}
+	if s := c.Stats(); s != want {
+		t.Fatalf("Stats() = %+v, want %+v", s, want)
+	}
+	if ratio := c.Stats().HitRatio(); ratio != 3.0/7 {
+		t.Fatalf("HitRatio() = %v, want 3/7", ratio)
+	}
+}
+
+func TestStatsCountRejectedEntries(t *testing.T) {
+	c := New(Options[string, string]{
+		Capacity: 4,
+		Cost:     func(key string, value string) int64 { return int64(len(value)) },
+	})
+	c.Put("a", "xxxxx")
+	if s := c.Stats(); s.Evictions != 1 {
+		t.Fatalf("%d evictions counted for an entry over the capacity, want 1", s.Evictions)
+	}
+}
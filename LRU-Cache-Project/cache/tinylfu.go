@@ -0,0 +1,220 @@
+package cache
+
+import "math/bits"
+
+const (
+	listWindow uint8 = iota
+	listProbation
+	listProtected
+)
+
+// tinyLFU is W-TinyLFU. New entries go into an LRU window of 1% of the
+// capacity, counted in cost like all sizes here. The entry pushed out of the
+// window competes with the victim of the main cache, a segmented LRU of
+// probation and protected entries: the one the sketch estimates to be used
+// more often stays. Entries hit while on probation move to the protected
+// segment.
+type tinyLFU[K comparable, V any] struct {
+	window    queue[K, V]
+	probation queue[K, V]
+	protected queue[K, V]
+
+	windowCapacity    int64
+	protectedCapacity int64
+
+	sketch *sketch
+	hash   func(key K) uint64
+}
+
+// initialSketch is the number of entries the sketch is first sized for. A
+// capacity that is a cost says little about the number of entries, so the
+// sketch grows with them instead, keeping its counts.
+const initialSketch = 1024
+
+func newTinyLFU[K comparable, V any](capacity int64, hash func(key K) uint64) *tinyLFU[K, V] {
+	windowCapacity := max(capacity/100, 1)
+	return &tinyLFU[K, V]{
+		window:            newQueue[K, V](),
+		probation:         newQueue[K, V](),
+		protected:         newQueue[K, V](),
+		windowCapacity:    windowCapacity,
+		protectedCapacity: (capacity - windowCapacity) * 8 / 10,
+		sketch:            newSketch(int(min(capacity, initialSketch))),
+		hash:              hash,
+	}
+}
+
+func (t *tinyLFU[K, V]) add(n *node[K, V]) {
+	if t.len() >= t.sketch.capacity {
+		t.sketch.grow()
+	}
+	t.sketch.increment(t.hash(n.key))
+	n.list = listWindow
+	t.window.pushFront(n)
+	// while the cache isn't full the window passes its entries on without
+	// a contest, evict holds it once it is
+	for t.window.cost > t.windowCapacity && t.window.length > 1 {
+		moved := t.window.back()
+		t.window.remove(moved)
+		moved.list = listProbation
+		t.probation.pushFront(moved)
+	}
+}
+
+func (t *tinyLFU[K, V]) hit(n *node[K, V]) {
+	t.sketch.increment(t.hash(n.key))
+	switch n.list {
+	case listWindow:
+		t.window.moveToFront(n)
+	case listProbation:
+		t.probation.remove(n)
+		n.list = listProtected
+		t.protected.pushFront(n)
+		// the protected segment makes room by demoting its least recently
+		// used entry
+		for t.protected.cost > t.protectedCapacity {
+			demoted := t.protected.back()
+			t.protected.remove(demoted)
+			demoted.list = listProbation
+			t.probation.pushFront(demoted)
+		}
+	case listProtected:
+		t.protected.moveToFront(n)
+	}
+}
+
+func (t *tinyLFU[K, V]) remove(n *node[K, V]) {
+	t.list(n.list).remove(n)
+}
+
+func (t *tinyLFU[K, V]) resize(n *node[K, V], cost int64) {
+	t.list(n.list).resize(n, cost)
+}
+
+func (t *tinyLFU[K, V]) evict(incoming K) *node[K, V] {
+	victim := t.probation.back()
+	if victim == nil {
+		victim = t.protected.back()
+	}
+	candidate := t.window.back()
+	if t.window.cost < t.windowCapacity && victim != nil {
+		// the window has room for the incoming entry
+		candidate = nil
+	}
+
+	switch {
+	case candidate == nil && victim == nil:
+		return nil
+	case candidate == nil:
+	case victim == nil || t.sketch.estimate(t.hash(candidate.key)) <= t.sketch.estimate(t.hash(victim.key)):
+		// the candidate loses ties, a one-hit wonder mustn't replace an
+		// entry that is used as rarely
+		t.window.remove(candidate)
+		return candidate
+	default:
+		t.window.remove(candidate)
+		candidate.list = listProbation
+		t.probation.pushFront(candidate)
+	}
+	t.list(victim.list).remove(victim)
+	return victim
+}
+
+func (t *tinyLFU[K, V]) walk(f func(n *node[K, V])) {
+	t.protected.walk(f)
+	t.window.walk(f)
+	t.probation.walk(f)
+}
+
+func (t *tinyLFU[K, V]) len() int {
+	return t.window.length + t.probation.length + t.protected.length
+}
+
+func (t *tinyLFU[K, V]) list(list uint8) *queue[K, V] {
+	switch list {
+	case listProbation:
+		return &t.probation
+	case listProtected:
+		return &t.protected
+	}
+	return &t.window
+}
+
+// sketch is a count-min sketch of 4-bit counters estimating how often keys
+// were seen. Once it counted ten times the entries it is sized for it halves
+// all counters, so the estimates follow changes in popularity.
+type sketch struct {
+	counters   []uint64 // 16 counters of 4 bits each
+	mask       uint64
+	capacity   int
+	additions  int
+	sampleSize int
+}
+
+func newSketch(capacity int) *sketch {
+	capacity = max(capacity, 1)
+	// a counter per entry and row, rounded up to a power of two
+	width := 1 << bits.Len(uint(max(capacity, 16)/16))
+	return &sketch{
+		counters:   make([]uint64, width*4),
+		mask:       uint64(width*4) - 1,
+		capacity:   capacity,
+		sampleSize: 10 * capacity,
+	}
+}
+
+// grow doubles the number of entries the sketch is sized for. A hash picks
+// the same word in the larger sketch or the one half the sketch above it,
+// both start out with the counters of the old word, so no estimate changes.
+func (s *sketch) grow() {
+	counters := make([]uint64, 2*len(s.counters))
+	copy(counters, s.counters)
+	copy(counters[len(s.counters):], s.counters)
+	s.counters = counters
+	s.mask = uint64(len(counters)) - 1
+	s.capacity *= 2
+	s.sampleSize = 10 * s.capacity
+}
+
+// seeds derive the four row hashes from one key hash.
+var sketchSeeds = [4]uint64{0xc3a5c85c97cb3127, 0xb492b66fbe98f273, 0x9ae16a3b2f90404f, 0xcbf29ce484222325}
+
+func (s *sketch) index(hash uint64, row int) (word int, shift uint) {
+	h := (hash ^ sketchSeeds[row]) * 0x9e3779b97f4a7c15
+	h ^= h >> 32
+	return int(h & s.mask), uint((h>>40)&15) * 4
+}
+
+func (s *sketch) increment(hash uint64) {
+	added := false
+	for row := range sketchSeeds {
+		word, shift := s.index(hash, row)
+		if (s.counters[word]>>shift)&15 < 15 {
+			s.counters[word] += 1 << shift
+			added = true
+		}
+	}
+	if added {
+		s.additions++
+		if s.additions >= s.sampleSize {
+			s.reset()
+		}
+	}
+}
+
+func (s *sketch) estimate(hash uint64) int {
+	lowest := 15
+	for row := range sketchSeeds {
+		word, shift := s.index(hash, row)
+		lowest = min(lowest, int((s.counters[word]>>shift)&15))
+	}
+	return lowest
+}
+
+// reset halves every counter.
+func (s *sketch) reset() {
+	for i := range s.counters {
+		s.counters[i] = (s.counters[i] >> 1) & 0x7777777777777777
+	}
+	s.additions /= 2
+}
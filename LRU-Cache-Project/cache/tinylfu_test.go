@@ -0,0 +1,51 @@
+package cache
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestSketchGrowKeepsEstimates(t *testing.T) {
+	s := newSketch(64)
+	r := rand.New(rand.NewSource(1))
+	hashes := make([]uint64, 200)
+	for i := range hashes {
+		hashes[i] = r.Uint64()
+		for range i % 16 {
+			s.increment(hashes[i])
+		}
+	}
+	before := make([]int, len(hashes))
+	for i, h := range hashes {
+		before[i] = s.estimate(h)
+	}
+
+	s.grow()
+	if s.capacity != 128 || s.sampleSize != 1280 {
+		t.Fatalf("grown to capacity %d, sample size %d, want 128 and 1280", s.capacity, s.sampleSize)
+	}
+	for i, h := range hashes {
+		if got := s.estimate(h); got != before[i] {
+			t.Fatalf("estimate of hash %d went from %d to %d", i, before[i], got)
+		}
+	}
+}
+
+func TestTinyLFUKeepsCountsWhileGrowing(t *testing.T) {
+	c := New(Options[int, int]{Capacity: 4 * initialSketch, Policy: TinyLFU})
+	c.Put(-1, 0)
+	for range 10 {
+		c.Get(-1)
+	}
+	// fills the cache past the first size of the sketch
+	for i := range 2 * initialSketch {
+		c.Put(i, i)
+	}
+	tl := c.shards[0].policy.(*tinyLFU[int, int])
+	if tl.sketch.capacity <= initialSketch {
+		t.Fatalf("the sketch is sized for %d entries, want it grown", tl.sketch.capacity)
+	}
+	if n := tl.sketch.estimate(c.hash(-1)); n < 10 {
+		t.Fatalf("the hot key is estimated at %d uses after growing, want 10 or more", n)
+	}
+}
@@ -0,0 +1,80 @@
+package cache
+
+const (
+	listIn uint8 = iota
+	listMain
+)
+
+// twoQueue is the full 2Q policy. New entries wait in the FIFO in queue;
+// those evicted from it are remembered in the out ghost, and a key that
+// comes back while remembered goes to the LRU main queue. Repeated accesses
+// while in the in queue don't promote an entry, they are usually correlated.
+type twoQueue[K comparable, V any] struct {
+	in   queue[K, V]
+	main queue[K, V]
+	out  ghost[K, V]
+	kin  int64 // the cost the in queue may grow to before it's evicted from
+}
+
+func newTwoQueue[K comparable, V any](capacity int64) *twoQueue[K, V] {
+	return &twoQueue[K, V]{
+		in:   newQueue[K, V](),
+		main: newQueue[K, V](),
+		out:  newGhost[K, V](max(capacity/2, 1)),
+		kin:  max(capacity/4, 1),
+	}
+}
+
+func (q *twoQueue[K, V]) add(n *node[K, V]) {
+	if q.out.remove(n.key) {
+		n.list = listMain
+		q.main.pushFront(n)
+		return
+	}
+	n.list = listIn
+	q.in.pushFront(n)
+}
+
+func (q *twoQueue[K, V]) hit(n *node[K, V]) {
+	if n.list == listMain {
+		q.main.moveToFront(n)
+	}
+}
+
+func (q *twoQueue[K, V]) remove(n *node[K, V]) {
+	if n.list == listMain {
+		q.main.remove(n)
+		return
+	}
+	q.in.remove(n)
+}
+
+func (q *twoQueue[K, V]) resize(n *node[K, V], cost int64) {
+	if n.list == listMain {
+		q.main.resize(n, cost)
+		return
+	}
+	q.in.resize(n, cost)
+}
+
+func (q *twoQueue[K, V]) evict(incoming K) *node[K, V] {
+	if q.in.cost >= q.kin || q.main.length == 0 {
+		if n := q.in.back(); n != nil {
+			q.in.remove(n)
+			q.out.add(n)
+			return n
+		}
+	}
+	n := q.main.back()
+	if n != nil {
+		q.main.remove(n)
+	}
+	return n
+}
+
+func (q *twoQueue[K, V]) walk(f func(n *node[K, V])) {
+	q.main.walk(f)
+	q.in.walk(f)
+}
+
+func (q *twoQueue[K, V]) len() int { return q.in.length + q.main.length }
@@ -0,0 +1,102 @@
+// Command cacheserver runs a cache as a daemon that speaks a subset of the
+// Redis protocol, see package server for the commands.
+//
+// Usage:
+//
+//	go run ./cmd/cacheserver -addr :6380 -max-memory 268435456 -policy tinylfu
+//	redis-cli -p 6380 set greeting hello EX 60
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/dev-dhanushkumar/LRU-Cache-Project/cache"
+	"github.com/dev-dhanushkumar/LRU-Cache-Project/server"
+)
+
+func main() {
+	addr := flag.String("addr", ":6380", "address to listen on")
+	capacity := flag.Int64("capacity", 100_000, "number of keys held, unless -max-memory is set")
+	maxMemory := flag.Int64("max-memory", 0, "bytes of keys and values held, instead of a number of keys")
+	policyName := flag.String("policy", "lru", "eviction policy: lru, lfu, 2q, arc or tinylfu")
+	shards := flag.Int("shards", 16, "independently locked shards")
+	cleanup := flag.Duration("cleanup-interval", time.Second, "how often expired keys are removed")
+	snapshot := flag.String("snapshot", "", "file the cache is loaded from at startup and saved to at shutdown")
+	saveInterval := flag.Duration("save-interval", 0, "how often the snapshot is saved meanwhile, 0 for only at shutdown")
+	flag.Parse()
+
+	policy, err := cache.ParsePolicy(*policyName)
+	handleErr(err)
+
+	opts := cache.Options[string, []byte]{
+		Capacity:        *capacity,
+		Policy:          policy,
+		Shards:          *shards,
+		CleanupInterval: *cleanup,
+	}
+	config := server.Config{Policy: policy, Capacity: *capacity, Snapshot: *snapshot}
+	if *maxMemory > 0 {
+		opts.Capacity = *maxMemory
+		opts.Cost = func(key string, value []byte) int64 { return int64(len(key) + len(value)) }
+		config.Capacity, config.Bytes = *maxMemory, true
+	}
+	if opts.Capacity < 1 {
+		handleErr(fmt.Errorf("capacity must be positive"))
+	}
+	c := cache.New(opts)
+	defer c.Close()
+
+	if *snapshot != "" {
+		err := c.LoadFile(*snapshot)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			handleErr(err)
+		}
+		if err == nil {
+			fmt.Printf("loaded %d keys from %s\n", c.Len(), *snapshot)
+		}
+		if *saveInterval > 0 {
+			go save(c, *snapshot, *saveInterval)
+		}
+	}
+
+	srv := server.New(c, config)
+	done := make(chan error, 1)
+	go func() { done <- srv.ListenAndServe(*addr) }()
+	fmt.Printf("serving cache at %s\n", *addr)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-done:
+		handleErr(err)
+	case <-stop:
+		fmt.Println("shutting down")
+		srv.Close()
+	}
+	if *snapshot != "" {
+		handleErr(c.SaveFile(*snapshot))
+		fmt.Printf("saved %d keys to %s\n", c.Len(), *snapshot)
+	}
+}
+
+// save saves a snapshot every interval, so a crash loses at most that much.
+func save(c *cache.Cache[string, []byte], path string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := c.SaveFile(path); err != nil {
+			fmt.Printf("saving snapshot: %v\n", err)
+		}
+	}
+}
+
+func handleErr(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cacheserver: %v\n", err)
+		os.Exit(1)
+	}
+}
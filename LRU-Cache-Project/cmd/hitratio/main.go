@@ -0,0 +1,153 @@
+// Command hitratio replays a trace through every eviction policy and prints
+// their hit ratios side by side.
+//
+// A trace is a text file with one access per line, the first field of the
+// line being the key. Without a trace a synthetic workload is generated:
+//
+//	zipf  skewed accesses, a few keys are very popular
+//	scan  the zipf workload interrupted by scans over keys never seen again
+//	loop  a loop over more keys than fit, where LRU never hits
+//
+// Usage:
+//
+//	go run ./cmd/hitratio -workload scan -capacity 100,1000
+//	go run ./cmd/hitratio -trace trace.txt -capacity 5000 -policies lru,arc
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dev-dhanushkumar/LRU-Cache-Project/cache"
+)
+
+func main() {
+	tracePath := flag.String("trace", "", "trace file with one key per line, instead of a synthetic workload")
+	workload := flag.String("workload", "zipf", "synthetic workload: zipf, scan or loop")
+	requests := flag.Int("requests", 1_000_000, "accesses of the synthetic workload")
+	keys := flag.Int("keys", 100_000, "distinct keys of the synthetic workload")
+	seed := flag.Int64("seed", 1, "random seed of the synthetic workload")
+	capacities := flag.String("capacity", "1000", "comma separated cache capacities")
+	policies := flag.String("policies", "lru,lfu,2q,arc,tinylfu", "comma separated policies")
+	flag.Parse()
+
+	var trace []string
+	var err error
+	if *tracePath != "" {
+		trace, err = readTrace(*tracePath)
+	} else {
+		trace, err = generate(*workload, *requests, *keys, *seed)
+	}
+	handleErr(err)
+
+	var sizes []int
+	for _, field := range strings.Split(*capacities, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || size < 1 {
+			handleErr(fmt.Errorf("invalid capacity %q", field))
+		}
+		sizes = append(sizes, size)
+	}
+	var ps []cache.Policy
+	for _, field := range strings.Split(*policies, ",") {
+		p, err := cache.ParsePolicy(strings.TrimSpace(field))
+		handleErr(err)
+		ps = append(ps, p)
+	}
+
+	fmt.Printf("%d accesses\n", len(trace))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprint(w, "capacity\t")
+	for _, p := range ps {
+		fmt.Fprintf(w, "%s\t", p)
+	}
+	fmt.Fprintln(w)
+	for _, size := range sizes {
+		fmt.Fprintf(w, "%d\t", size)
+		for _, p := range ps {
+			fmt.Fprintf(w, "%.2f%%\t", 100*replay(trace, p, size))
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+}
+
+// replay runs trace through a cache that loads every key it misses and
+// returns the share of hits.
+func replay(trace []string, p cache.Policy, capacity int) float64 {
+	c := cache.New(cache.Options[string, struct{}]{Capacity: int64(capacity), Policy: p})
+	hits := 0
+	for _, key := range trace {
+		if _, ok := c.Get(key); ok {
+			hits++
+			continue
+		}
+		c.Put(key, struct{}{})
+	}
+	return float64(hits) / float64(max(len(trace), 1))
+}
+
+func readTrace(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var trace []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 0 {
+			trace = append(trace, fields[0])
+		}
+	}
+	return trace, scanner.Err()
+}
+
+func generate(workload string, requests int, keys int, seed int64) ([]string, error) {
+	if requests < 1 || keys < 2 {
+		return nil, fmt.Errorf("need at least 1 request and 2 keys")
+	}
+	r := rand.New(rand.NewSource(seed))
+	zipf := rand.NewZipf(r, 1.1, 1, uint64(keys-1))
+
+	trace := make([]string, 0, requests)
+	switch workload {
+	case "zipf":
+		for range requests {
+			trace = append(trace, strconv.FormatUint(zipf.Uint64(), 10))
+		}
+	case "scan":
+		// every tenth of the way a scan of keys/10 keys that appear once
+		scanned := 0
+		for len(trace) < requests {
+			if len(trace)%(requests/10+1) == 0 {
+				for i := 0; i < keys/10 && len(trace) < requests; i++ {
+					trace = append(trace, "scan-"+strconv.Itoa(scanned))
+					scanned++
+				}
+			}
+			trace = append(trace, strconv.FormatUint(zipf.Uint64(), 10))
+		}
+	case "loop":
+		for i := range requests {
+			trace = append(trace, strconv.Itoa(i%keys))
+		}
+	default:
+		return nil, fmt.Errorf("unknown workload %q", workload)
+	}
+	return trace, nil
+}
+
+func handleErr(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "hitratio: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const (
+	maxBulkLength = 512 << 20 // as in Redis
+	maxArguments  = 1 << 20
+	maxInline     = 64 << 10
+)
+
+// errProtocol ends the connection, the stream can't be parsed any further.
+var errProtocol = errors.New("protocol error")
+
+// reader reads commands in RESP, as arrays of bulk strings, or as inline
+// commands of space separated words the way telnet sends them.
+type reader struct {
+	r *bufio.Reader
+}
+
+func newReader(r io.Reader) *reader {
+	return &reader{r: bufio.NewReader(r)}
+}
+
+// buffered reports whether more input is waiting, the replies are flushed
+// once a pipeline of commands has been read.
+func (rd *reader) buffered() bool {
+	return rd.r.Buffered() > 0
+}
+
+// readCommand returns the arguments of the next command, the name first.
+// Empty inline lines are skipped.
+func (rd *reader) readCommand() ([][]byte, error) {
+	for {
+		line, err := rd.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != '*' {
+			if args := bytes.Fields(line); len(args) > 0 {
+				return args, nil
+			}
+			continue
+		}
+
+		count, err := strconv.Atoi(string(line[1:]))
+		if err != nil || count > maxArguments {
+			return nil, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+		}
+		if count <= 0 {
+			continue
+		}
+		args := make([][]byte, count)
+		for i := range args {
+			if args[i], err = rd.readBulk(); err != nil {
+				return nil, err
+			}
+		}
+		return args, nil
+	}
+}
+
+func (rd *reader) readBulk() ([]byte, error) {
+	line, err := rd.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '$' {
+		return nil, fmt.Errorf("%w: expected '$', got '%s'", errProtocol, line)
+	}
+	length, err := strconv.Atoi(string(line[1:]))
+	if err != nil || length < 0 || length > maxBulkLength {
+		return nil, fmt.Errorf("%w: invalid bulk length", errProtocol)
+	}
+	// the buffer grows with the data that arrives, a client claiming a huge
+	// length without sending it doesn't get the memory reserved
+	var bulk bytes.Buffer
+	if _, err := io.CopyN(&bulk, rd.r, int64(length)+2); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if !bytes.HasSuffix(bulk.Bytes(), []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: bulk string not terminated", errProtocol)
+	}
+	return bulk.Bytes()[:length], nil
+}
+
+// readLine returns a line without its line ending.
+func (rd *reader) readLine() ([]byte, error) {
+	line, err := rd.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		// longer than the buffer, only inline commands get here
+		var long []byte
+		long = append(long, line...)
+		for errors.Is(err, bufio.ErrBufferFull) && len(long) <= maxInline {
+			line, err = rd.r.ReadSlice('\n')
+			long = append(long, line...)
+		}
+		if len(long) > maxInline {
+			return nil, fmt.Errorf("%w: too big inline request", errProtocol)
+		}
+		line = long
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+	// the line is only valid until the next read
+	return bytes.Clone(line), nil
+}
+
+// writer writes replies in RESP. Errors are left to flush.
+type writer struct {
+	w *bufio.Writer
+}
+
+func newWriter(w io.Writer) *writer {
+	return &writer{w: bufio.NewWriter(w)}
+}
+
+func (wr *writer) simple(s string) {
+	wr.w.WriteString("+" + s + "\r\n")
+}
+
+func (wr *writer) error(msg string) {
+	wr.w.WriteString("-" + msg + "\r\n")
+}
+
+func (wr *writer) integer(n int64) {
+	wr.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (wr *writer) bulk(b []byte) {
+	wr.w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	wr.w.Write(b)
+	wr.w.WriteString("\r\n")
+}
+
+// null is the reply for a missing value.
+func (wr *writer) null() {
+	wr.w.WriteString("$-1\r\n")
+}
+
+func (wr *writer) array(length int) {
+	wr.w.WriteString("*" + strconv.Itoa(length) + "\r\n")
+}
+
+func (wr *writer) flush() error {
+	return wr.w.Flush()
+}
@@ -0,0 +1,348 @@
+// Package server serves a cache over TCP in a subset of the Redis protocol
+// (RESP), so any Redis client can use it.
+//
+// Supported commands: GET, SET key value [EX seconds | PX milliseconds],
+// DEL, EXISTS, TTL, INFO, SAVE, PING, ECHO, COMMAND and QUIT.
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dev-dhanushkumar/LRU-Cache-Project/cache"
+)
+
+// Config describes the cache a Server serves, INFO reports it.
+type Config struct {
+	Policy   cache.Policy
+	Capacity int64
+	// Bytes tells that Capacity and the cost of the entries are in bytes
+	// rather than a number of entries.
+	Bytes bool
+	// Snapshot is the file SAVE writes, SAVE fails when it's empty.
+	Snapshot string
+}
+
+// Server serves a cache to RESP clients.
+type Server struct {
+	cache  *cache.Cache[string, []byte]
+	config Config
+
+	started  time.Time
+	commands atomic.Int64
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func New(c *cache.Cache[string, []byte], config Config) *Server {
+	return &Server{cache: c, config: config, started: time.Now(), conns: map[net.Conn]struct{}{}}
+}
+
+// ListenAndServe listens on addr and serves clients until Close, it returns
+// nil then.
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve serves the clients that connect to ln until Close, it returns nil
+// then.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return nil
+	}
+	s.listener = ln
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			// e.g. out of file descriptors, back off instead of spinning
+			fmt.Printf("accept: %v\n", err)
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return nil
+		}
+		go func() {
+			defer s.untrack(conn)
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// Close stops accepting clients, disconnects the connected ones and waits
+// for the commands they were running.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	conn.Close()
+	s.wg.Done()
+}
+
+func (s *Server) clients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// serveConn runs the commands of one client until it quits or breaks the
+// protocol. Replies to pipelined commands are flushed together.
+func (s *Server) serveConn(conn net.Conn) {
+	r := newReader(conn)
+	w := newWriter(conn)
+	for {
+		args, err := r.readCommand()
+		if errors.Is(err, errProtocol) {
+			w.error("ERR " + err.Error())
+			w.flush()
+			return
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				fmt.Printf("client %s: %v\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		s.commands.Add(1)
+		quit := s.execute(w, args)
+		if quit || !r.buffered() {
+			if err := w.flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// execute runs one command and writes its reply. It reports true for QUIT.
+func (s *Server) execute(w *writer, args [][]byte) (quit bool) {
+	name := strings.ToUpper(string(args[0]))
+	args = args[1:]
+
+	switch name {
+	case "PING":
+		if len(args) > 1 {
+			wrongArity(w, name)
+		} else if len(args) == 1 {
+			w.bulk(args[0])
+		} else {
+			w.simple("PONG")
+		}
+	case "ECHO":
+		if len(args) != 1 {
+			wrongArity(w, name)
+			break
+		}
+		w.bulk(args[0])
+	case "GET":
+		if len(args) != 1 {
+			wrongArity(w, name)
+			break
+		}
+		if value, ok := s.cache.Get(string(args[0])); ok {
+			w.bulk(value)
+		} else {
+			w.null()
+		}
+	case "SET":
+		s.set(w, args)
+	case "DEL":
+		if len(args) == 0 {
+			wrongArity(w, name)
+			break
+		}
+		var deleted int64
+		for _, key := range args {
+			if s.cache.Delete(string(key)) {
+				deleted++
+			}
+		}
+		w.integer(deleted)
+	case "EXISTS":
+		if len(args) == 0 {
+			wrongArity(w, name)
+			break
+		}
+		// a key given twice counts twice, as in Redis
+		var found int64
+		for _, key := range args {
+			if _, ok := s.cache.Peek(string(key)); ok {
+				found++
+			}
+		}
+		w.integer(found)
+	case "TTL":
+		if len(args) != 1 {
+			wrongArity(w, name)
+			break
+		}
+		ttl, ok := s.cache.TTL(string(args[0]))
+		switch {
+		case !ok:
+			w.integer(-2)
+		case ttl == 0:
+			w.integer(-1)
+		default:
+			w.integer(int64((ttl + 500*time.Millisecond) / time.Second))
+		}
+	case "INFO":
+		w.bulk([]byte(s.info()))
+	case "SAVE":
+		if s.config.Snapshot == "" {
+			w.error("ERR no snapshot file configured")
+			break
+		}
+		if err := s.cache.SaveFile(s.config.Snapshot); err != nil {
+			w.error("ERR " + err.Error())
+			break
+		}
+		w.simple("OK")
+	case "COMMAND":
+		// clients ask for the command table when they connect, an empty one
+		// tells them nothing is known about the commands
+		w.array(0)
+	case "QUIT":
+		w.simple("OK")
+		return true
+	default:
+		w.error(fmt.Sprintf("ERR unknown command '%s'", shorten(name)))
+	}
+	return false
+}
+
+// set runs SET key value [EX seconds | PX milliseconds]. A value without
+// an expiry doesn't expire.
+func (s *Server) set(w *writer, args [][]byte) {
+	if len(args) < 2 {
+		wrongArity(w, "SET")
+		return
+	}
+	key, value := string(args[0]), args[1]
+
+	var ttl time.Duration
+	for options := args[2:]; len(options) > 0; options = options[2:] {
+		option := strings.ToUpper(string(options[0]))
+		if (option != "EX" && option != "PX") || len(options) < 2 || ttl != 0 {
+			w.error("ERR syntax error")
+			return
+		}
+		n, err := strconv.ParseInt(string(options[1]), 10, 64)
+		if err != nil || n <= 0 {
+			w.error("ERR invalid expire time in 'set' command")
+			return
+		}
+		unit := time.Second
+		if option == "PX" {
+			unit = time.Millisecond
+		}
+		if n > int64(time.Duration(1<<63-1)/unit) {
+			w.error("ERR invalid expire time in 'set' command")
+			return
+		}
+		ttl = time.Duration(n) * unit
+	}
+	s.cache.PutWithTTL(key, value, ttl)
+	w.simple("OK")
+}
+
+// info renders the INFO reply, in sections of field:value lines.
+func (s *Server) info() string {
+	var b strings.Builder
+	section := func(name string) { fmt.Fprintf(&b, "# %s\r\n", name) }
+	field := func(name string, value any) { fmt.Fprintf(&b, "%s:%v\r\n", name, value) }
+
+	section("Server")
+	field("uptime_in_seconds", int64(time.Since(s.started).Seconds()))
+	b.WriteString("\r\n")
+
+	section("Clients")
+	field("connected_clients", s.clients())
+	b.WriteString("\r\n")
+
+	section("Memory")
+	if s.config.Bytes {
+		field("used_memory", s.cache.Cost())
+		field("maxmemory", s.config.Capacity)
+	} else {
+		field("maxkeys", s.config.Capacity)
+	}
+	field("maxmemory_policy", s.config.Policy)
+	b.WriteString("\r\n")
+
+	stats := s.cache.Stats()
+	section("Stats")
+	field("total_commands_processed", s.commands.Load())
+	field("keyspace_hits", stats.Hits)
+	field("keyspace_misses", stats.Misses)
+	field("evicted_keys", stats.Evictions)
+	field("expired_keys", stats.Expirations)
+	b.WriteString("\r\n")
+
+	section("Keyspace")
+	field("keys", s.cache.Len())
+	return b.String()
+}
+
+func wrongArity(w *writer, name string) {
+	w.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+}
+
+// shorten cuts a command name down for an error, it may be any junk a
+// client sent.
+func shorten(name string) string {
+	if len(name) > 128 {
+		name = name[:128]
+	}
+	return strings.ToLower(name)
+}
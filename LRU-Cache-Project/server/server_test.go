@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dev-dhanushkumar/LRU-Cache-Project/cache"
+)
+
+// serve starts a server on a free port and returns its address, the server
+// is closed when the test ends.
+func serve(t *testing.T) (*Server, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(cache.New(cache.Options[string, []byte]{Capacity: 100}), Config{Capacity: 100})
+	done := make(chan error)
+	go func() { done <- s.Serve(ln) }()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+	return s, ln.Addr().String()
+}
+
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *client {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *client) send(raw string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.conn, raw); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect reads exactly the bytes of want and fails when they differ.
+func (c *client) expect(want string) {
+	c.t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(c.r, got); err != nil {
+		c.t.Fatalf("reading %q: %v (got %q)", want, err, got)
+	}
+	if string(got) != want {
+		c.t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// command encodes args as a RESP array of bulk strings, the way clients
+// send commands.
+func command(args ...string) string {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	return b.String()
+}
+
+func TestCommands(t *testing.T) {
+	_, addr := serve(t)
+	c := dial(t, addr)
+
+	c.send(command("PING"))
+	c.expect("+PONG\r\n")
+	c.send(command("ECHO", "hello"))
+	c.expect("$5\r\nhello\r\n")
+
+	c.send(command("GET", "a"))
+	c.expect("$-1\r\n")
+	c.send(command("SET", "a", "one"))
+	c.expect("+OK\r\n")
+	c.send(command("GET", "a"))
+	c.expect("$3\r\none\r\n")
+	c.send(command("EXISTS", "a", "b", "a"))
+	c.expect(":2\r\n")
+	c.send(command("TTL", "a"))
+	c.expect(":-1\r\n")
+	c.send(command("SET", "b", "two", "EX", "100"))
+	c.expect("+OK\r\n")
+	c.send(command("TTL", "b"))
+	c.expect(":100\r\n")
+	c.send(command("TTL", "c"))
+	c.expect(":-2\r\n")
+	c.send(command("DEL", "a", "b", "c"))
+	c.expect(":2\r\n")
+	c.send(command("GET", "a"))
+	c.expect("$-1\r\n")
+
+	c.send(command("SET", "a"))
+	c.expect("-ERR wrong number of arguments for 'set' command\r\n")
+	c.send(command("SET", "a", "1", "EX", "0"))
+	c.expect("-ERR invalid expire time in 'set' command\r\n")
+	c.send(command("NOPE"))
+	c.expect("-ERR unknown command 'nope'\r\n")
+
+	c.send(command("QUIT"))
+	c.expect("+OK\r\n")
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Fatalf("read after QUIT: %v, want EOF", err)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	_, addr := serve(t)
+	c := dial(t, addr)
+
+	var pipeline, replies strings.Builder
+	for i := 0; i < 100; i++ {
+		key := "k" + strconv.Itoa(i)
+		pipeline.WriteString(command("SET", key, strconv.Itoa(i)))
+		pipeline.WriteString(command("GET", key))
+		replies.WriteString("+OK\r\n$" + strconv.Itoa(len(strconv.Itoa(i))) + "\r\n" + strconv.Itoa(i) + "\r\n")
+	}
+	c.send(pipeline.String())
+	c.expect(replies.String())
+}
+
+func TestInlineCommands(t *testing.T) {
+	_, addr := serve(t)
+	c := dial(t, addr)
+
+	c.send("SET a hello\r\n\r\nGET a\nPING\r\n")
+	c.expect("+OK\r\n$5\r\nhello\r\n+PONG\r\n")
+}
+
+func TestBulkInPieces(t *testing.T) {
+	_, addr := serve(t)
+	c := dial(t, addr)
+
+	value := strings.Repeat("x", 100000)
+	raw := command("SET", "a", value)
+	for len(raw) > 0 {
+		n := min(len(raw), 7000)
+		c.send(raw[:n])
+		raw = raw[n:]
+		time.Sleep(time.Millisecond)
+	}
+	c.expect("+OK\r\n")
+	c.send(command("GET", "a"))
+	c.expect("$100000\r\n" + value + "\r\n")
+}
+
+func TestProtocolErrors(t *testing.T) {
+	_, addr := serve(t)
+	for _, tc := range []struct {
+		raw   string
+		reply string
+	}{
+		{"*1\r\n$-5\r\n", "-ERR protocol error: invalid bulk length\r\n"},
+		{"*1\r\n$536870913\r\n", "-ERR protocol error: invalid bulk length\r\n"},
+		{"*x\r\n", "-ERR protocol error: invalid multibulk length\r\n"},
+		{"*1\r\n$3\r\nGETxx", "-ERR protocol error: bulk string not terminated\r\n"},
+		{"*1\r\n+GET\r\n", "-ERR protocol error: expected '$', got '+GET'\r\n"},
+	} {
+		c := dial(t, addr)
+		c.send(tc.raw)
+		c.expect(tc.reply)
+		if _, err := c.r.ReadByte(); err != io.EOF {
+			t.Fatalf("%q: read after the error: %v, want EOF", tc.raw, err)
+		}
+	}
+}
+
+func TestClaimedBulkLengthIsNotReserved(t *testing.T) {
+	s, addr := serve(t)
+	// the largest allowed length, with only a little of the data
+	var clients []*client
+	for i := 0; i < 4; i++ {
+		c := dial(t, addr)
+		c.send("*1\r\n$536870912\r\n" + strings.Repeat("x", 1000))
+		clients = append(clients, c)
+	}
+
+	// the server still answers others meanwhile
+	other := dial(t, addr)
+	other.send(command("PING"))
+	other.expect("+PONG\r\n")
+	time.Sleep(50 * time.Millisecond)
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	if stats.HeapAlloc > 256<<20 {
+		t.Fatalf("%d MiB allocated for the bulks claimed", stats.HeapAlloc>>20)
+	}
+
+	for _, c := range clients {
+		c.conn.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.clients() > 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the clients sending a partial bulk are still connected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCloseDisconnectsClients(t *testing.T) {
+	s, addr := serve(t)
+	c := dial(t, addr)
+	c.send(command("PING"))
+	c.expect("+PONG\r\n")
+
+	s.Close()
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Fatal("client still connected after Close")
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("server still accepting after Close")
+	}
+}
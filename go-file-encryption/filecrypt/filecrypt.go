@@ -1,119 +1,80 @@
 package filecrypt
 
 import (
+	"bufio"
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
 	"crypto/sha1"
-	"encoding/hex"
 	"io"
-	"os"
 
 	"golang.org/x/crypto/pbkdf2"
 )
 
+// Encrypt encrypts the file at source in place with the default options,
+// it panics when that fails.
 func Encrypt(source string, password []byte) {
-	if _, err := os.Stat(source); os.IsNotExist(err) {
-		panic(err.Error())
-	}
-
-	srcFile, err := os.Open(source)
-	if err != nil {
-		panic(err.Error())
-	}
-
-	defer srcFile.Close()
-
-	plainText, err := io.ReadAll(srcFile)
-	if err != nil {
-		panic(err.Error())
-	}
-
-	key := password
-
-	nonce := make([]byte, 12) //[0,0,0,0,0,0,0,0,0,0,0,0]
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		panic(err.Error())
-	}
-
-	dk := pbkdf2.Key(key, nonce, 4096, 32, sha1.New)
-
-	block, err := aes.NewCipher(dk)
-	if err != nil {
-		panic(err.Error())
-	}
-
-	// GCM Function
-	aesgcm, err := cipher.NewGCM(block)
-	if err != nil {
-		panic(err.Error())
-	}
-
-	ciphertext := aesgcm.Seal(nil, nonce, plainText, nil)
-	ciphertext = append(ciphertext, nonce...)
-
-	dstFile, err := os.Create(source)
-	if err != nil {
-		panic(err.Error())
-	}
-
-	defer dstFile.Close()
-
-	_, err = dstFile.Write(ciphertext)
-	if err != nil {
+	if err := EncryptFile(source, password, Options{}); err != nil {
 		panic(err.Error())
 	}
 }
 
+// Decrypt decrypts the file at source in place, it panics when that fails.
 func Decrypt(source string, password []byte) {
-	if _, err := os.Stat(source); os.IsExist(err) {
+	if err := DecryptFile(source, password, Options{}); err != nil {
 		panic(err.Error())
 	}
+}
 
-	srcFile, err := os.Open(source)
-	if err != nil {
-		panic(err.Error())
-	}
+// EncryptFile encrypts the file at source, in place unless opts.Output is
+// set. The file is streamed, so its size doesn't matter, and the result
+// only appears once it's encrypted entirely.
+func EncryptFile(source string, password []byte, opts Options) error {
+	return transformFile(source, opts, func(dst io.Writer, src io.Reader) error {
+		return EncryptStream(dst, src, password, opts)
+	})
+}
 
-	defer srcFile.Close()
+// DecryptFile decrypts the file at source like EncryptFile encrypts it.
+// Files of every version decrypt, back to the first one: a single GCM
+// message followed by its nonce.
+func DecryptFile(source string, password []byte, opts Options) error {
+	return transformFile(source, opts, func(dst io.Writer, src io.Reader) error {
+		in := bufio.NewReader(src)
+		if b, _ := in.Peek(len(magic)); !isEncrypted(b) {
+			return decryptLegacy(dst, in, password)
+		}
+		return DecryptStream(dst, in, password)
+	})
+}
 
-	ciphertext, err := io.ReadAll(srcFile)
+// decryptLegacy decrypts the format before the chunked one: one GCM message
+// of the whole file followed by the 12 byte nonce, which also salted the
+// key. These files were read whole to be written, so they fit in memory.
+func decryptLegacy(dst io.Writer, src io.Reader, password []byte) error {
+	ciphertext, err := io.ReadAll(src)
 	if err != nil {
-		panic(err.Error())
+		return err
+	}
+	if len(ciphertext) < 12+16 {
+		return ErrNotEncrypted
 	}
 
-	key := password
-	salt := ciphertext[len(ciphertext)-12:]
-	str := hex.EncodeToString(salt)
-	nonce, err := hex.DecodeString(str)
-
-	dk := pbkdf2.Key(key, nonce, 4096, 32, sha1.New)
+	nonce := ciphertext[len(ciphertext)-12:]
+	dk := pbkdf2.Key(password, nonce, pbkdf2Iters, 32, sha1.New)
 
 	block, err := aes.NewCipher(dk)
 	if err != nil {
-		panic(err.Error())
+		return err
 	}
-
 	aesgcm, err := cipher.NewGCM(block)
 	if err != nil {
-		panic(err.Error())
+		return err
 	}
 
 	plainText, err := aesgcm.Open(nil, nonce, ciphertext[:len(ciphertext)-12], nil)
 	if err != nil {
-		panic(err.Error())
-	}
-
-	dstFile, err := os.Create(source)
-	if err != nil {
-		panic(err.Error())
+		return ErrAuth
 	}
-
-	defer dstFile.Close()
-
-	_, err = dstFile.Write(plainText)
-	if err != nil {
-		panic(err.Error())
-	}
-
+	_, err = dst.Write(plainText)
+	return err
 }
@@ -0,0 +1,225 @@
+package filecrypt
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// The header of an encrypted file, all integers big endian:
+//
+//	magic        8 bytes  "GOFCRYPT"
+//	version      1 byte   2
+//	kdf          1 byte   1 Argon2id, 2 scrypt
+//	kdf params  12 bytes  Argon2id: time, memory in KiB, threads
+//	                      scrypt: N, r, p
+//	salt        16 bytes
+//	chunk size   4 bytes
+//	nonce prefix 7 bytes
+//
+// Version 1 had no kdf and kdf params, its key was derived with PBKDF2.
+const (
+	magic       = "GOFCRYPT"
+	version     = 2
+	saltSize    = 16
+	pbkdf2Iters = 4096
+
+	headerSizeV1 = len(magic) + 1 + 4 + saltSize + prefixSize
+	headerSize   = len(magic) + 1 + 1 + 12 + saltSize + 4 + prefixSize
+)
+
+// KDF is the function that derives the key of a file from its password.
+type KDF byte
+
+const (
+	pbkdf2SHA1 KDF = iota // of version 1 files, 4096 iterations of SHA-1
+	// Argon2id with 3 passes over 64 MiB in 4 threads, as RFC 9106
+	// recommends for machines with less memory.
+	Argon2id
+	// Scrypt with N=32768, r=8, p=1.
+	Scrypt
+)
+
+var kdfNames = []string{pbkdf2SHA1: "pbkdf2", Argon2id: "argon2id", Scrypt: "scrypt"}
+
+func (k KDF) String() string {
+	if int(k) >= len(kdfNames) {
+		return fmt.Sprintf("KDF(%d)", byte(k))
+	}
+	return kdfNames[k]
+}
+
+// ParseKDF returns the KDF named argon2id or scrypt.
+func ParseKDF(name string) (KDF, error) {
+	for _, k := range []KDF{Argon2id, Scrypt} {
+		if strings.EqualFold(name, k.String()) {
+			return k, nil
+		}
+	}
+	return 0, fmt.Errorf("filecrypt: unknown key derivation function %q", name)
+}
+
+// defaultParams are written into new headers, a file keeps the parameters
+// it was encrypted with when the defaults change.
+func (k KDF) defaultParams() [3]uint32 {
+	if k == Scrypt {
+		return [3]uint32{1 << 15, 8, 1}
+	}
+	return [3]uint32{3, 64 * 1024, 4}
+}
+
+// Limits on the parameters read from a header, a crafted file mustn't make
+// decryption take all memory or forever. The work is the memory mixed over
+// all passes, the defaults take 192 MiB of it for Argon2id and 32 MiB for
+// scrypt.
+const (
+	maxKDFMemory = 1 << 30 // bytes
+	maxKDFWork   = 4 << 30 // bytes
+)
+
+type header struct {
+	version   byte
+	kdf       KDF
+	params    [3]uint32
+	salt      [saltSize]byte
+	chunkSize uint32
+	prefix    [prefixSize]byte
+}
+
+func (h *header) marshal() []byte {
+	b := make([]byte, 0, headerSize)
+	b = append(b, magic...)
+	b = append(b, version, byte(h.kdf))
+	for _, p := range h.params {
+		b = binary.BigEndian.AppendUint32(b, p)
+	}
+	b = append(b, h.salt[:]...)
+	b = binary.BigEndian.AppendUint32(b, h.chunkSize)
+	return append(b, h.prefix[:]...)
+}
+
+// readHeader reads the header of either version and returns it along with
+// its bytes, which the chunks authenticate.
+func readHeader(r io.Reader) (*header, []byte, error) {
+	b := make([]byte, len(magic)+1, headerSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, nil, ErrNotEncrypted
+		}
+		return nil, nil, err
+	}
+	if !isEncrypted(b) {
+		return nil, nil, ErrNotEncrypted
+	}
+
+	h := &header{version: b[len(magic)]}
+	size := headerSize
+	switch h.version {
+	case 1:
+		size = headerSizeV1
+	case version:
+	default:
+		return nil, nil, fmt.Errorf("filecrypt: unsupported format version %d", h.version)
+	}
+	b = b[:size]
+	if _, err := io.ReadFull(r, b[len(magic)+1:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, nil, ErrTruncated
+		}
+		return nil, nil, err
+	}
+
+	rest := b[len(magic)+1:]
+	if h.version == 1 {
+		h.kdf = pbkdf2SHA1
+		h.chunkSize = binary.BigEndian.Uint32(rest)
+		copy(h.salt[:], rest[4:])
+		copy(h.prefix[:], rest[4+saltSize:])
+	} else {
+		h.kdf = KDF(rest[0])
+		for i := range h.params {
+			h.params[i] = binary.BigEndian.Uint32(rest[1+4*i:])
+		}
+		copy(h.salt[:], rest[13:])
+		h.chunkSize = binary.BigEndian.Uint32(rest[13+saltSize:])
+		copy(h.prefix[:], rest[17+saltSize:])
+	}
+	if err := h.validate(); err != nil {
+		return nil, nil, err
+	}
+	return h, b, nil
+}
+
+func (h *header) validate() error {
+	if h.chunkSize == 0 || h.chunkSize > maxChunk {
+		return fmt.Errorf("filecrypt: invalid chunk size %d", h.chunkSize)
+	}
+	p := h.params
+	switch h.kdf {
+	case pbkdf2SHA1:
+		if h.version == 1 {
+			return nil
+		}
+	case Argon2id:
+		if validArgon2(p[0], p[1], p[2]) {
+			return nil
+		}
+		return fmt.Errorf("filecrypt: invalid argon2id parameters %v", p)
+	case Scrypt:
+		if validScrypt(p[0], p[1], p[2]) {
+			return nil
+		}
+		return fmt.Errorf("filecrypt: invalid scrypt parameters %v", p)
+	}
+	return fmt.Errorf("filecrypt: unknown key derivation function %d", byte(h.kdf))
+}
+
+// validArgon2 reports whether Argon2id can run with passes over memory KiB
+// in threads lanes, within the limits.
+func validArgon2(passes uint32, memory uint32, threads uint32) bool {
+	if passes < 1 || threads < 1 || threads > 255 || memory < 8*threads {
+		return false
+	}
+	size := uint64(memory) * 1024
+	return size <= maxKDFMemory && uint64(passes)*size <= maxKDFWork
+}
+
+// validScrypt reports whether scrypt can run with cost n, block size r and
+// parallelism p within the limits. It takes 128·r·(n+p) bytes, and mixes
+// 128·n·r of them p times.
+func validScrypt(n uint32, r uint32, p uint32) bool {
+	if n < 2 || n&(n-1) != 0 || r < 1 || p < 1 {
+		return false
+	}
+	// compared by division, the products of the parameters could overflow
+	block := 128 * uint64(r)
+	if uint64(n)+uint64(p) > maxKDFMemory/block {
+		return false
+	}
+	return uint64(p) <= maxKDFWork/(block*uint64(n))
+}
+
+// isEncrypted reports whether b starts like a file of this format.
+func isEncrypted(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(magic))
+}
+
+// key derives the AES-256 key of the file from password.
+func (h *header) key(password []byte) ([]byte, error) {
+	p := h.params
+	switch h.kdf {
+	case Argon2id:
+		return argon2.IDKey(password, h.salt[:], p[0], p[1], uint8(p[2]), 32), nil
+	case Scrypt:
+		return scrypt.Key(password, h.salt[:], int(p[0]), int(p[1]), int(p[2]), 32)
+	}
+	return pbkdf2.Key(password, h.salt[:], pbkdf2Iters, 32, sha1.New), nil
+}
@@ -0,0 +1,159 @@
+package filecrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestHeaderLimits(t *testing.T) {
+	for _, tc := range []struct {
+		kdf    KDF
+		params [3]uint32
+		valid  bool
+	}{
+		{Argon2id, Argon2id.defaultParams(), true},
+		{Argon2id, [3]uint32{4, 1 << 20, 4}, true},      // 1 GiB 4 times
+		{Argon2id, [3]uint32{5, 1 << 20, 4}, false},     // over the work
+		{Argon2id, [3]uint32{1, 1<<20 + 1, 4}, false},   // over the memory
+		{Argon2id, [3]uint32{1, 1<<32 - 1, 255}, false}, // 4 TiB
+		{Argon2id, [3]uint32{1<<32 - 1, 64, 1}, false},  // forever
+		{Argon2id, [3]uint32{0, 64 * 1024, 4}, false},   // no pass
+		{Argon2id, [3]uint32{3, 64 * 1024, 0}, false},   // no thread
+		{Argon2id, [3]uint32{3, 64 * 1024, 256}, false}, // threads don't fit a byte
+		{Argon2id, [3]uint32{3, 7, 1}, false},           // under 8 KiB per thread
+		{Scrypt, Scrypt.defaultParams(), true},
+		{Scrypt, [3]uint32{1 << 19, 8, 8}, true},          // 512 MiB 8 times
+		{Scrypt, [3]uint32{1 << 19, 8, 9}, false},         // over the work
+		{Scrypt, [3]uint32{1 << 20, 8, 1}, false},         // over the memory
+		{Scrypt, [3]uint32{1 << 31, 1<<32 - 1, 1}, false}, // the product overflows
+		{Scrypt, [3]uint32{1 << 10, 8, 1<<32 - 1}, false},
+		{Scrypt, [3]uint32{1000, 8, 1}, false}, // not a power of 2
+		{Scrypt, [3]uint32{1, 8, 1}, false},
+		{Scrypt, [3]uint32{1 << 15, 0, 1}, false},
+		{Scrypt, [3]uint32{1 << 15, 8, 0}, false},
+	} {
+		h := &header{version: version, kdf: tc.kdf, params: tc.params, chunkSize: ChunkSize}
+		if err := h.validate(); (err == nil) != tc.valid {
+			t.Errorf("%v %v: validate() = %v, want valid %v", tc.kdf, tc.params, err, tc.valid)
+		}
+	}
+}
+
+// TestCostlyHeaderRejected decrypts headers asking for terabytes of memory
+// or years of work. Deriving a key from one of them runs out of memory or
+// doesn't end, so the test only passes when the header is refused first.
+func TestCostlyHeaderRejected(t *testing.T) {
+	for _, h := range []*header{
+		{kdf: Argon2id, params: [3]uint32{3, 1<<32 - 1, 4}},
+		{kdf: Argon2id, params: [3]uint32{1<<32 - 1, 1 << 20, 4}},
+		{kdf: Scrypt, params: [3]uint32{1 << 30, 8, 1}},
+		{kdf: Scrypt, params: [3]uint32{1 << 15, 8, 1<<30 - 1}},
+	} {
+		h.chunkSize = ChunkSize
+		encrypted := append(h.marshal(), make([]byte, 100)...)
+		_, err := decrypt(encrypted, testPassword)
+		if err == nil || errors.Is(err, ErrAuth) || !strings.Contains(err.Error(), "parameters") {
+			t.Errorf("%v %v: %v, want the parameters refused", h.kdf, h.params, err)
+		}
+	}
+}
+
+func TestDecryptVersion2(t *testing.T) {
+	plain := randomBytes(t, ChunkSize+10)
+	for _, kdf := range []KDF{Argon2id, Scrypt} {
+		var enc bytes.Buffer
+		if err := EncryptStream(&enc, bytes.NewReader(plain), testPassword, Options{KDF: kdf}); err != nil {
+			t.Fatal(err)
+		}
+		encrypted := enc.Bytes()
+		if encrypted[len(magic)] != 2 || KDF(encrypted[len(magic)+1]) != kdf {
+			t.Fatalf("%v: header starts %x, want version 2 and the kdf", kdf, encrypted[:len(magic)+2])
+		}
+		got, err := decrypt(encrypted, testPassword)
+		if err != nil {
+			t.Fatalf("%v: %v", kdf, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("%v: decrypted plaintext differs", kdf)
+		}
+	}
+}
+
+// TestDecryptVersion1 decrypts a file written with the version 1 header,
+// which had no kdf and derived the key with PBKDF2.
+func TestDecryptVersion1(t *testing.T) {
+	const chunkSize = 16
+	plain := randomBytes(t, 3*chunkSize+5)
+	salt := randomBytes(t, saltSize)
+	var prefix [prefixSize]byte
+	copy(prefix[:], randomBytes(t, prefixSize))
+
+	header := []byte(magic)
+	header = append(header, 1)
+	header = binary.BigEndian.AppendUint32(header, chunkSize)
+	header = append(header, salt...)
+	header = append(header, prefix[:]...)
+
+	block, _ := aes.NewCipher(pbkdf2.Key(testPassword, salt, pbkdf2Iters, 32, sha1.New))
+	aesgcm, _ := cipher.NewGCM(block)
+	encrypted := bytes.Clone(header)
+	for index := 0; index*chunkSize < len(plain); index++ {
+		chunk := plain[index*chunkSize : min((index+1)*chunkSize, len(plain))]
+		last := (index+1)*chunkSize >= len(plain)
+		encrypted = aesgcm.Seal(encrypted, chunkNonce(prefix, uint64(index), last), chunk, header)
+	}
+
+	got, err := decrypt(encrypted, testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatal("decrypted plaintext differs")
+	}
+	if _, err := decrypt(encrypted, []byte("wrong")); !errors.Is(err, ErrAuth) {
+		t.Fatalf("wrong password: %v, want %v", err, ErrAuth)
+	}
+}
+
+func TestUnknownHeader(t *testing.T) {
+	h := &header{kdf: Scrypt, params: Scrypt.defaultParams(), chunkSize: ChunkSize}
+	encrypted := append(h.marshal(), make([]byte, 100)...)
+
+	unknownVersion := bytes.Clone(encrypted)
+	unknownVersion[len(magic)] = 3
+	unknownKDF := bytes.Clone(encrypted)
+	unknownKDF[len(magic)+1] = 9
+	noKDF := bytes.Clone(encrypted)
+	noKDF[len(magic)+1] = byte(pbkdf2SHA1) // only version 1 used PBKDF2
+	hugeChunks := bytes.Clone(encrypted)
+	binary.BigEndian.PutUint32(hugeChunks[len(magic)+2+12+saltSize:], maxChunk+1)
+
+	for _, tc := range []struct {
+		name      string
+		encrypted []byte
+		want      string
+	}{
+		{"unknown version", unknownVersion, "unsupported format version 3"},
+		{"unknown kdf", unknownKDF, "unknown key derivation function 9"},
+		{"pbkdf2 in version 2", noKDF, "unknown key derivation function 0"},
+		{"huge chunks", hugeChunks, "invalid chunk size"},
+	} {
+		if _, err := decrypt(tc.encrypted, testPassword); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: %v, want %q", tc.name, err, tc.want)
+		}
+	}
+
+	// a version 1 header is shorter, a version 2 one cut to its size isn't
+	// whole
+	if _, err := decrypt(encrypted[:headerSizeV1], testPassword); !errors.Is(err, ErrTruncated) {
+		t.Errorf("short header: %v, want %v", err, ErrTruncated)
+	}
+}
@@ -0,0 +1,131 @@
+package filecrypt
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// transformFile runs transform from the file at source to a temporary file
+// next to the output, which then takes the place of the output: opts.Output
+// or source itself. A failure, or a crash, leaves both as they were. The
+// output gets the permissions and modification time of source.
+func transformFile(source string, opts Options, transform func(dst io.Writer, src io.Reader) error) error {
+	output := opts.Output
+	if output == "" || sameFile(source, output) {
+		output = source
+	} else if _, err := os.Lstat(output); err == nil {
+		// checked again when the output is linked, this saves the work
+		return fmt.Errorf("filecrypt: %s: %w", output, fs.ErrExist)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	// the source is overwritten through this file once the output is in
+	// place, in place that's the only way left to the old data
+	flag := os.O_RDONLY
+	if opts.SecureRemove {
+		flag = os.O_RDWR
+	}
+	srcFile, err := os.OpenFile(source, flag, 0)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	info, err := srcFile.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("filecrypt: %s is not a regular file", source)
+	}
+	dstFile, err := os.CreateTemp(filepath.Dir(output), "."+filepath.Base(output)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dstFile.Name()) // fails once renamed, a link leaves it
+
+	if err := transform(dstFile, srcFile); err != nil {
+		dstFile.Close()
+		return err
+	}
+	if err := dstFile.Chmod(info.Mode().Perm()); err != nil {
+		dstFile.Close()
+		return err
+	}
+	// on disk before the rename, or a crash could leave an empty output
+	if err := dstFile.Sync(); err != nil {
+		dstFile.Close()
+		return err
+	}
+	if err := dstFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Chtimes(dstFile.Name(), info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+
+	if output == source {
+		err = os.Rename(dstFile.Name(), output)
+	} else {
+		// unlike a rename a link never replaces a file created meanwhile
+		err = os.Link(dstFile.Name(), output)
+	}
+	if err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(output)); err != nil {
+		return err
+	}
+
+	if !opts.SecureRemove {
+		return nil
+	}
+	if err := overwrite(srcFile, info.Size()); err != nil {
+		return fmt.Errorf("filecrypt: overwriting %s: %w", source, err)
+	}
+	if output == source {
+		return nil
+	}
+	if err := os.Remove(source); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(source))
+}
+
+// overwrite writes random data over the first size bytes of f and flushes
+// it to disk.
+func overwrite(f *os.File, size int64) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(f, rand.Reader, size); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// syncDir flushes a directory, so a rename in it survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// not every platform can sync a directory, the rename happened anyway
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) && !errors.Is(err, errors.ErrUnsupported) {
+		return err
+	}
+	return nil
+}
+
+func sameFile(a string, b string) bool {
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	return errA == nil && errB == nil && os.SameFile(infoA, infoB)
+}
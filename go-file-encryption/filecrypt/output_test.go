@@ -0,0 +1,212 @@
+package filecrypt
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+var errTransform = errors.New("transform failed")
+
+// writeFile writes data to name in dir and returns its path.
+func writeFile(t *testing.T, dir string, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// checkFile fails unless the file at path holds want.
+func checkFile(t *testing.T, path string, want []byte) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s holds %d bytes other than expected", filepath.Base(path), len(got))
+	}
+}
+
+// checkDir fails unless dir holds exactly the files named, so no temporary
+// file was left behind.
+func checkDir(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Name())
+	}
+	slices.Sort(names)
+	if !slices.Equal(got, names) {
+		t.Fatalf("the directory holds %q, want %q", got, names)
+	}
+}
+
+func TestOutputNeverReplaced(t *testing.T) {
+	dir := t.TempDir()
+	plain := []byte("the source")
+	source := writeFile(t, dir, "source", plain)
+	output := writeFile(t, dir, "output", []byte("already there"))
+
+	err := EncryptFile(source, testPassword, Options{KDF: Scrypt, Output: output, SecureRemove: true})
+	if !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("EncryptFile to an existing output: %v, want %v", err, fs.ErrExist)
+	}
+	checkFile(t, output, []byte("already there"))
+	checkFile(t, source, plain)
+
+	// created while the source is being transformed, the source is only
+	// removed once the output is in place, so it stays
+	os.Remove(output)
+	err = transformFile(source, Options{Output: output, SecureRemove: true}, func(dst io.Writer, src io.Reader) error {
+		writeFile(t, dir, "output", []byte("created meanwhile"))
+		_, err := io.Copy(dst, src)
+		return err
+	})
+	if !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("transformFile to an output created meanwhile: %v, want %v", err, fs.ErrExist)
+	}
+	checkFile(t, output, []byte("created meanwhile"))
+	checkFile(t, source, plain)
+	checkDir(t, dir, "source", "output")
+}
+
+func TestFailedTransformLeavesSource(t *testing.T) {
+	for _, opts := range []Options{{}, {SecureRemove: true}, {Output: "output"}, {Output: "output", SecureRemove: true}} {
+		dir := t.TempDir()
+		plain := []byte("the source")
+		source := writeFile(t, dir, "source", plain)
+		if opts.Output != "" {
+			opts.Output = filepath.Join(dir, opts.Output)
+		}
+
+		err := transformFile(source, opts, func(dst io.Writer, src io.Reader) error {
+			io.Copy(dst, src)
+			return errTransform
+		})
+		if !errors.Is(err, errTransform) {
+			t.Fatalf("%+v: %v, want %v", opts, err, errTransform)
+		}
+		checkFile(t, source, plain)
+		checkDir(t, dir, "source")
+	}
+
+	// a wrong password fails the same way
+	dir := t.TempDir()
+	source := writeFile(t, dir, "source", []byte("the source"))
+	if err := EncryptFile(source, testPassword, testOptions); err != nil {
+		t.Fatal(err)
+	}
+	encrypted, _ := os.ReadFile(source)
+	if err := DecryptFile(source, []byte("wrong"), Options{SecureRemove: true}); !errors.Is(err, ErrAuth) {
+		t.Fatalf("wrong password: %v, want %v", err, ErrAuth)
+	}
+	checkFile(t, source, encrypted)
+	checkDir(t, dir, "source")
+}
+
+func TestOutputKeepsModeAndTime(t *testing.T) {
+	mtime := time.Date(2020, 2, 29, 12, 30, 0, 0, time.UTC)
+	for _, output := range []string{"", "output"} {
+		dir := t.TempDir()
+		source := writeFile(t, dir, "source", []byte("the source"))
+		if err := os.Chmod(source, 0o640); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(source, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		opts := testOptions
+		if output != "" {
+			opts.Output = filepath.Join(dir, output)
+		}
+
+		if err := EncryptFile(source, testPassword, opts); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(cmp.Or(opts.Output, source))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0o640 {
+			t.Errorf("output %q: mode %v, want %v", output, info.Mode().Perm(), fs.FileMode(0o640))
+		}
+		if !info.ModTime().Equal(mtime) {
+			t.Errorf("output %q: modified %v, want %v", output, info.ModTime(), mtime)
+		}
+	}
+}
+
+func TestSecureRemove(t *testing.T) {
+	plain := bytes.Repeat([]byte("secret "), 1000)
+
+	// a second link to the source shows what became of its data
+	dir := t.TempDir()
+	source := writeFile(t, dir, "source", plain)
+	if err := os.Link(source, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "output")
+	if err := EncryptFile(source, testPassword, Options{KDF: Scrypt, Output: output, SecureRemove: true}); err != nil {
+		t.Fatal(err)
+	}
+	checkDir(t, dir, "link", "output")
+	overwritten, _ := os.ReadFile(filepath.Join(dir, "link"))
+	if len(overwritten) != len(plain) || bytes.Contains(overwritten, []byte("secret")) {
+		t.Fatal("the removed source wasn't overwritten")
+	}
+	if err := DecryptFile(output, testPassword, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, output, plain)
+
+	// in place the old data is overwritten, the path holds the result
+	dir = t.TempDir()
+	source = writeFile(t, dir, "source", plain)
+	if err := os.Link(source, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncryptFile(source, testPassword, Options{KDF: Scrypt, SecureRemove: true}); err != nil {
+		t.Fatal(err)
+	}
+	checkDir(t, dir, "link", "source")
+	overwritten, _ = os.ReadFile(filepath.Join(dir, "link"))
+	if len(overwritten) != len(plain) || bytes.Contains(overwritten, []byte("secret")) {
+		t.Fatal("the replaced source wasn't overwritten")
+	}
+	if err := DecryptFile(source, testPassword, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, source, plain)
+}
+
+func TestSecureRemoveNeedsWritableSource(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to any file")
+	}
+	dir := t.TempDir()
+	plain := []byte("the source")
+	source := writeFile(t, dir, "source", plain)
+	if err := os.Chmod(source, 0o400); err != nil {
+		t.Fatal(err)
+	}
+	err := EncryptFile(source, testPassword, Options{KDF: Scrypt, Output: filepath.Join(dir, "output"), SecureRemove: true})
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("EncryptFile of a read-only source: %v, want %v", err, fs.ErrPermission)
+	}
+	checkFile(t, source, plain)
+	checkDir(t, dir, "source")
+}
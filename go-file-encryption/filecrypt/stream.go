@@ -0,0 +1,189 @@
+package filecrypt
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// An encrypted file starts with a header and continues with the plaintext
+// sealed in chunks of ChunkSize bytes, the last one possibly shorter and
+// only empty for an empty file. Every chunk is a GCM message of its own,
+// with the header as additional data and a nonce of
+//
+//	nonce prefix (7 bytes) || chunk index (4 bytes, big endian) || last (1 byte)
+//
+// so chunks can't be reordered or dropped, and a file cut off at a chunk
+// boundary is told apart from a complete one by the last flag.
+const (
+	ChunkSize  = 64 * 1024
+	prefixSize = 7
+	maxChunk   = 16 << 20 // refused when reading a header, memory is per chunk
+	maxChunks  = 1 << 32
+)
+
+var (
+	ErrNotEncrypted = errors.New("filecrypt: not an encrypted file")
+	ErrAuth         = errors.New("filecrypt: wrong password or corrupted file")
+	ErrTruncated    = errors.New("filecrypt: file is truncated")
+)
+
+// Options are the choices of encryption and decryption, the zero value
+// picks the defaults.
+type Options struct {
+	KDF KDF // Argon2id by default, decryption takes the one of the file
+
+	// Output is where EncryptFile and DecryptFile write the result, the
+	// source stays as it is. It must not exist yet, a file created there
+	// meanwhile isn't overwritten either; the result is hard linked into
+	// place for that. Empty means the result replaces the source.
+	Output string
+
+	// SecureRemove overwrites the source with random data once the result
+	// is in place, and removes it unless the result replaced it, so the
+	// plaintext can't be read back from the disk. The source has to be
+	// writable. Journaling and copy-on-write filesystems and SSDs may keep
+	// copies of the old blocks regardless.
+	SecureRemove bool
+}
+
+func newGCM(h *header, password []byte) (cipher.AEAD, error) {
+	dk, err := h.key(password)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(dk)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix [prefixSize]byte, index uint64, last bool) []byte {
+	nonce := make([]byte, 0, 12)
+	nonce = append(nonce, prefix[:]...)
+	nonce = binary.BigEndian.AppendUint32(nonce, uint32(index))
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// EncryptStream encrypts everything read from src to dst, holding one chunk
+// in memory at a time.
+func EncryptStream(dst io.Writer, src io.Reader, password []byte, opts Options) error {
+	h := &header{version: version, kdf: opts.KDF, chunkSize: ChunkSize}
+	if h.kdf == pbkdf2SHA1 {
+		h.kdf = Argon2id
+	}
+	h.params = h.kdf.defaultParams()
+	if err := h.validate(); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rand.Reader, h.salt[:]); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rand.Reader, h.prefix[:]); err != nil {
+		return err
+	}
+	aesgcm, err := newGCM(h, password)
+	if err != nil {
+		return err
+	}
+	ad := h.marshal()
+	if _, err := dst.Write(ad); err != nil {
+		return err
+	}
+
+	in := bufio.NewReaderSize(src, ChunkSize)
+	plainText := make([]byte, ChunkSize)
+	sealed := make([]byte, 0, ChunkSize+aesgcm.Overhead())
+	for index := uint64(0); ; index++ {
+		if index >= maxChunks {
+			return errors.New("filecrypt: file too large")
+		}
+		n, err := io.ReadFull(in, plainText)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+		// a full chunk is the last one when nothing follows it
+		last := n < ChunkSize
+		if !last {
+			if _, err := in.Peek(1); errors.Is(err, io.EOF) {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+
+		sealed = aesgcm.Seal(sealed[:0], chunkNonce(h.prefix, index, last), plainText[:n], ad)
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// DecryptStream decrypts a stream written by EncryptStream from src to dst,
+// with the key derivation its header names.
+// A chunk is only written once it has been authenticated, but the chunks
+// before a corrupted one have been written by the time the error is
+// returned. It returns ErrNotEncrypted when src doesn't start with a
+// header.
+func DecryptStream(dst io.Writer, src io.Reader, password []byte) error {
+	h, ad, err := readHeader(src)
+	if err != nil {
+		return err
+	}
+	aesgcm, err := newGCM(h, password)
+	if err != nil {
+		return err
+	}
+
+	in := bufio.NewReaderSize(src, int(h.chunkSize)+aesgcm.Overhead())
+	sealed := make([]byte, int(h.chunkSize)+aesgcm.Overhead())
+	plainText := make([]byte, 0, h.chunkSize)
+	for index := uint64(0); ; index++ {
+		if index >= maxChunks {
+			return errors.New("filecrypt: file too large")
+		}
+		n, err := io.ReadFull(in, sealed)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+		if n < aesgcm.Overhead() {
+			return ErrTruncated
+		}
+		last := n < len(sealed)
+		if !last {
+			if _, err := in.Peek(1); errors.Is(err, io.EOF) {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+
+		plainText, err = aesgcm.Open(plainText[:0], chunkNonce(h.prefix, index, last), sealed[:n], ad)
+		if err != nil {
+			if last {
+				// the chunk may be fine but sealed as not the last one
+				if _, err := aesgcm.Open(nil, chunkNonce(h.prefix, index, false), sealed[:n], ad); err == nil {
+					return ErrTruncated
+				}
+			}
+			return ErrAuth
+		}
+		if _, err := dst.Write(plainText); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
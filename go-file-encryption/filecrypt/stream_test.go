@@ -0,0 +1,225 @@
+package filecrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var testPassword = []byte("correct horse battery staple")
+
+// scrypt derives keys faster than Argon2id, the tests derive a lot of them
+var testOptions = Options{KDF: Scrypt}
+
+const sealedChunk = ChunkSize + 16 // a full chunk with its GCM tag
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func encrypt(t *testing.T, plain []byte) []byte {
+	t.Helper()
+	var enc bytes.Buffer
+	if err := EncryptStream(&enc, bytes.NewReader(plain), testPassword, testOptions); err != nil {
+		t.Fatal(err)
+	}
+	return enc.Bytes()
+}
+
+func decrypt(encrypted []byte, password []byte) ([]byte, error) {
+	var dec bytes.Buffer
+	err := DecryptStream(&dec, bytes.NewReader(encrypted), password)
+	return dec.Bytes(), err
+}
+
+// chunks splits an encrypted stream into its header and sealed chunks.
+func chunks(encrypted []byte) (header []byte, sealed [][]byte) {
+	header, rest := encrypted[:headerSize], encrypted[headerSize:]
+	for len(rest) > sealedChunk {
+		sealed = append(sealed, rest[:sealedChunk])
+		rest = rest[sealedChunk:]
+	}
+	return header, append(sealed, rest)
+}
+
+func join(header []byte, sealed ...[]byte) []byte {
+	return bytes.Join(append([][]byte{header}, sealed...), nil)
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 100} {
+		plain := randomBytes(t, size)
+		encrypted := encrypt(t, plain)
+
+		// every chunk is full but the last, which is only empty for an
+		// empty stream
+		wantChunks := max((size+ChunkSize-1)/ChunkSize, 1)
+		if want := headerSize + size + 16*wantChunks; len(encrypted) != want {
+			t.Errorf("%d bytes encrypt to %d, want %d", size, len(encrypted), want)
+		}
+		got, err := decrypt(encrypted, testPassword)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("%d bytes: decrypted plaintext differs", size)
+		}
+	}
+}
+
+// TestChunkLayout seals the chunks independently of EncryptStream, so a
+// change to the nonce or the additional data shows up as a broken format.
+func TestChunkLayout(t *testing.T) {
+	plain := randomBytes(t, 2*ChunkSize+10)
+	header, sealed := chunks(encrypt(t, plain))
+
+	h, ad, err := readHeader(bytes.NewReader(header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ad, header) {
+		t.Fatal("the additional data isn't the header")
+	}
+	key, err := h.key(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := aes.NewCipher(key)
+	aesgcm, _ := cipher.NewGCM(block)
+
+	for i, last := range []byte{0, 0, 1} {
+		// nonce prefix || chunk index || last flag
+		nonce := append(h.prefix[:], 0, 0, 0, byte(i), last)
+		want := aesgcm.Seal(nil, nonce, plain[i*ChunkSize:min((i+1)*ChunkSize, len(plain))], header)
+		if !bytes.Equal(sealed[i], want) {
+			t.Fatalf("chunk %d isn't sealed with the nonce and additional data of the format", i)
+		}
+	}
+}
+
+func TestStreamWrongPassword(t *testing.T) {
+	encrypted := encrypt(t, []byte("attack at dawn"))
+	if _, err := decrypt(encrypted, []byte("wrong")); !errors.Is(err, ErrAuth) {
+		t.Fatalf("wrong password: %v, want %v", err, ErrAuth)
+	}
+}
+
+func TestStreamTampering(t *testing.T) {
+	plain := randomBytes(t, 3*ChunkSize+100)
+	encrypted := encrypt(t, plain)
+	header, sealed := chunks(encrypted)
+	if len(sealed) != 4 {
+		t.Fatalf("%d chunks, want 4", len(sealed))
+	}
+	_, otherSealed := chunks(encrypt(t, plain))
+
+	flippedHeader := bytes.Clone(header)
+	flippedHeader[headerSize-1] ^= 1 // in the nonce prefix
+	flippedSalt := bytes.Clone(header)
+	flippedSalt[len(magic)+2+12] ^= 1
+	flippedChunk := bytes.Clone(sealed[1])
+	flippedChunk[100] ^= 1
+
+	for _, tc := range []struct {
+		name      string
+		encrypted []byte
+		want      error
+	}{
+		{"swapped chunks", join(header, sealed[1], sealed[0], sealed[2], sealed[3]), ErrAuth},
+		{"reordered chunks", join(header, sealed[2], sealed[0], sealed[1], sealed[3]), ErrAuth},
+		{"duplicated chunk", join(header, sealed[0], sealed[0], sealed[1], sealed[2], sealed[3]), ErrAuth},
+		{"dropped chunk", join(header, sealed[0], sealed[2], sealed[3]), ErrAuth},
+		{"chunk of another file", join(header, sealed[0], otherSealed[1], sealed[2], sealed[3]), ErrAuth},
+		{"flipped header byte", join(flippedHeader, sealed...), ErrAuth},
+		{"flipped salt byte", join(flippedSalt, sealed...), ErrAuth},
+		{"flipped chunk byte", join(header, sealed[0], flippedChunk, sealed[2], sealed[3]), ErrAuth},
+		{"appended byte", append(bytes.Clone(encrypted), 0), ErrAuth},
+		{"cut at a chunk boundary", join(header, sealed[0], sealed[1]), ErrTruncated},
+		{"cut after the header", header, ErrTruncated},
+		{"cut inside the header", header[:headerSize-1], ErrTruncated},
+		{"cut inside a chunk", encrypted[:len(encrypted)-1], ErrAuth},
+	} {
+		if _, err := decrypt(tc.encrypted, testPassword); !errors.Is(err, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestStreamNotEncrypted(t *testing.T) {
+	for _, b := range [][]byte{nil, []byte("GOF"), []byte("plain text, not encrypted")} {
+		if _, err := decrypt(b, testPassword); !errors.Is(err, ErrNotEncrypted) {
+			t.Errorf("%q: %v, want %v", b, err, ErrNotEncrypted)
+		}
+	}
+}
+
+// legacyEncrypt writes plain the way the first release did: a single GCM
+// message followed by its nonce, which also salted the key.
+func legacyEncrypt(t *testing.T, path string, plain []byte) {
+	t.Helper()
+	nonce := randomBytes(t, 12)
+	block, _ := aes.NewCipher(pbkdf2.Key(testPassword, nonce, 4096, 32, sha1.New))
+	aesgcm, _ := cipher.NewGCM(block)
+	if err := os.WriteFile(path, append(aesgcm.Seal(nil, nonce, plain, nil), nonce...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecryptLegacyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy")
+	plain := []byte("encrypted before the file format had a header")
+
+	legacyEncrypt(t, path, plain)
+	if err := DecryptFile(path, []byte("wrong"), Options{}); !errors.Is(err, ErrAuth) {
+		t.Fatalf("wrong password: %v, want %v", err, ErrAuth)
+	}
+	if err := DecryptFile(path, testPassword, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, plain) {
+		t.Fatalf("decrypted %q, want %q", got, plain)
+	}
+
+	// shorter than a nonce and a tag
+	if err := os.WriteFile(path, []byte("short"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := DecryptFile(path, testPassword, Options{}); !errors.Is(err, ErrNotEncrypted) {
+		t.Fatalf("short file: %v, want %v", err, ErrNotEncrypted)
+	}
+}
+
+func TestFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	plain := randomBytes(t, 2*ChunkSize+1)
+	if err := os.WriteFile(path, plain, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := EncryptFile(path, testPassword, testOptions); err != nil {
+		t.Fatal(err)
+	}
+	encrypted, _ := os.ReadFile(path)
+	if !isEncrypted(encrypted) {
+		t.Fatal("the file isn't encrypted")
+	}
+	if err := DecryptFile(path, testPassword, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, plain) {
+		t.Fatal("decrypted file differs")
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
 	"os"
 
@@ -35,7 +36,8 @@ func printHelp() {
 	fmt.Println("")
 	fmt.Println("Usage:")
 	fmt.Println("")
-	fmt.Println("\tgo run . encrypt /path/to/your/file")
+	fmt.Println("\tgo run . encrypt [-kdf argon2id|scrypt] [-o output] [-remove] /path/to/your/file")
+	fmt.Println("\tgo run . decrypt [-o output] [-remove] /path/to/your/file")
 	fmt.Println((""))
 	fmt.Println("Commands")
 	fmt.Println("")
@@ -43,32 +45,54 @@ func printHelp() {
 	fmt.Println("\t decrypt\tTries to Decrypt a file using a password")
 	fmt.Println("\t help\t\tDisplay help text")
 	fmt.Println("")
+	fmt.Println("Options")
+	fmt.Println("")
+	fmt.Println("\t -o\t\tWrite the result to a new file and keep the original")
+	fmt.Println("\t -remove\tOverwrite the original with random data before removing it")
+	fmt.Println("")
 
 }
 
 func encryptHandle() {
-	if len(os.Args) < 3 {
+	flags := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	kdfName := flags.String("kdf", "argon2id", "key derivation function, argon2id or scrypt")
+	output := flags.String("o", "", "write the encrypted file here instead of replacing the original")
+	remove := flags.Bool("remove", false, "overwrite the original with random data before removing it")
+	flags.Parse(os.Args[2:])
+	if flags.NArg() < 1 {
 		fmt.Println("missing the path to the file. For more info, run go run . help")
 		os.Exit(0)
 	}
-	file := os.Args[2]
+	kdf, err := filecrypt.ParseKDF(*kdfName)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	file := flags.Arg(0)
 	if !validateFile(file) {
 		panic("File not found")
 	}
 
 	password := getPassword()
 	fmt.Println("\nEncrypting...")
-	filecrypt.Encrypt(file, password)
+	if err := filecrypt.EncryptFile(file, password, filecrypt.Options{KDF: kdf, Output: *output, SecureRemove: *remove}); err != nil {
+		fmt.Println("\n" + err.Error())
+		os.Exit(1)
+	}
 	fmt.Println("\n File sucessfully protected")
 }
 
 func decryptHandle() {
-	if len(os.Args) < 3 {
+	flags := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	output := flags.String("o", "", "write the decrypted file here instead of replacing the original")
+	remove := flags.Bool("remove", false, "overwrite the original with random data before removing it")
+	flags.Parse(os.Args[2:])
+	if flags.NArg() < 1 {
 		fmt.Println("missing the path to the file. For more info, run go run . help")
 		os.Exit(0)
 	}
 
-	file := os.Args[2]
+	file := flags.Arg(0)
 	if !validateFile(file) {
 		panic("File not found")
 	}
@@ -76,7 +100,10 @@ func decryptHandle() {
 	fmt.Println("Enter password: ")
 	password, _ := term.ReadPassword(0)
 	fmt.Println("\nDecrypting... ")
-	filecrypt.Decrypt(file, password)
+	if err := filecrypt.DecryptFile(file, password, filecrypt.Options{Output: *output, SecureRemove: *remove}); err != nil {
+		fmt.Println("\n" + err.Error())
+		os.Exit(1)
+	}
 	fmt.Println("\nfile sucessfully decrypted")
 }
 
@@ -87,7 +114,7 @@ func getPassword() []byte {
 	password2, _ := term.ReadPassword(0)
 
 	if !validatePassword(password, password2) {
-		fmt.Println("\nPassword do not match. Please try again\n")
+		fmt.Println("\nPassword do not match. Please try again")
 		return getPassword()
 	}
 
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// accessEntry is one line of the access log, for a proxied request or a
+// passthrough connection.
+type accessEntry struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Client     string    `json:"client"`
+	Listener   string    `json:"listener"`
+	Method     string    `json:"method,omitempty"`
+	Host       string    `json:"host,omitempty"`
+	URI        string    `json:"uri,omitempty"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status,omitempty"`
+	Bytes      int64     `json:"bytes"`
+	DurationMs float64   `json:"duration_ms"`
+	Pool       string    `json:"pool,omitempty"`
+	Route      string    `json:"route,omitempty"`
+	Upstream   string    `json:"upstream,omitempty"`
+	Retries    int       `json:"retries"`
+	Cache      string    `json:"cache,omitempty"` // HIT, MISS, REVALIDATED or BYPASS on caching routes
+	Error      string    `json:"error,omitempty"` // the last failure, kept when a retry succeeds
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+}
+
+// accessLogger writes one line per request, either as JSON or in the
+// combined log format with the balancing details appended.
+type accessLogger struct {
+	format string // "json", "common" or "off"
+	mu     sync.Mutex
+	out    io.Writer
+}
+
+func newAccessLogger(settings accessLogSettings) (*accessLogger, error) {
+	al := &accessLogger{format: "json", out: os.Stdout}
+	if settings.Format != "" {
+		al.format = settings.Format
+	}
+	if settings.Path != "" && al.format != "off" {
+		f, err := os.OpenFile(settings.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("access log: %w", err)
+		}
+		al.out = f
+	}
+	return al, nil
+}
+
+// start fills in what is known about r before it is proxied.
+func (al *accessLogger) start(r *http.Request, listener string) *accessEntry {
+	return &accessEntry{
+		Time:      time.Now(),
+		RequestID: r.Header.Get(requestIDHeader),
+		Client:    clientIP(r),
+		Listener:  listener,
+		Method:    r.Method,
+		Host:      r.Host,
+		URI:       r.RequestURI,
+		Proto:     r.Proto,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+	}
+}
+
+// finish stamps the duration on e and writes it.
+func (al *accessLogger) finish(e *accessEntry) {
+	if al.format == "off" {
+		return
+	}
+	e.DurationMs = float64(time.Since(e.Time).Microseconds()) / 1000
+
+	var line []byte
+	if al.format == "common" {
+		line = e.common()
+	} else {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.out.Write(line)
+}
+
+// common renders e in the combined log format, followed by key=value pairs
+// for the balancing details.
+func (e *accessEntry) common() []byte {
+	request := e.Proto
+	if e.Method != "" {
+		request = e.Method + " " + e.URI + " " + e.Proto
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s - - [%s] %q %s %s %q %q", e.Client, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		request, dash(e.Status), dash(e.Bytes), orDash(e.Referer), orDash(e.UserAgent))
+	fmt.Fprintf(&b, " request_id=%s listener=%s pool=%s upstream=%s retries=%d duration_ms=%.3f",
+		orDash(e.RequestID), e.Listener, orDash(e.Pool), orDash(e.Upstream), e.Retries, e.DurationMs)
+	if e.Cache != "" {
+		fmt.Fprintf(&b, " cache=%s", e.Cache)
+	}
+	if e.Error != "" {
+		fmt.Fprintf(&b, " error=%q", e.Error)
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+// dash prints 0 as "-", as the common log format does for a missing status
+// or an empty body.
+func dash[T int | int64](n T) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(int64(n), 10)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// ensureRequestID keeps a sane X-Request-ID sent by the client, or an
+// upstream proxy, and makes one up otherwise, so the backend and the access
+// log share it.
+func ensureRequestID(r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		b := make([]byte, 16)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+		r.Header.Set(requestIDHeader, id)
+	}
+	return id
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// setForwardedHeaders tells the backend how the client reached the load
+// balancer. X-Forwarded-For is appended to by the reverse proxy itself;
+// X-Forwarded-Proto and X-Forwarded-Host are overwritten since only this hop
+// knows them.
+func setForwardedHeaders(r *http.Request) {
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	r.Header.Set("X-Forwarded-Proto", proto)
+	r.Header.Set("X-Forwarded-Host", r.Host)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// adminState is set through the admin API and overrides health: a disabled
+// or draining server gets no new requests whatever its health checks say.
+type adminState int32
+
+const (
+	stateEnabled adminState = iota
+	stateDisabled
+	stateDraining
+)
+
+func (s adminState) String() string {
+	switch s {
+	case stateDisabled:
+		return "disabled"
+	case stateDraining:
+		return "draining"
+	}
+	return "enabled"
+}
+
+// backendStatus is the admin API view of one backend.
+type backendStatus struct {
+	Pool           string `json:"pool"`
+	Address        string `json:"address"`
+	State          string `json:"state"`
+	Alive          bool   `json:"alive"`
+	Available      bool   `json:"available"`
+	Weight         int    `json:"weight"`
+	InFlight       int64  `json:"in_flight"`
+	MaxConnections int    `json:"max_connections,omitempty"`
+	CircuitBreaker string `json:"circuit_breaker,omitempty"`
+	EjectionReason string `json:"ejection_reason,omitempty"`
+}
+
+func newBackendStatus(p *pool, server Server) backendStatus {
+	state := server.AdminState().String()
+	if server.AdminState() == stateDraining && server.InFlight() == 0 {
+		// nothing left to wait for, the backend can be taken down
+		state = "drained"
+	}
+	return backendStatus{
+		Pool:           p.name,
+		Address:        server.Address(),
+		State:          state,
+		Alive:          server.IsAlive(),
+		Available:      server.Up(),
+		Weight:         server.Weight(),
+		InFlight:       server.InFlight(),
+		MaxConnections: server.MaxConnections(),
+		CircuitBreaker: circuitState(server),
+		EjectionReason: ejectionReason(server),
+	}
+}
+
+// ejectionReason explains why a server gets no traffic, "" when it does.
+func ejectionReason(server Server) string {
+	switch {
+	case server.AdminState() != stateEnabled:
+		return server.AdminState().String() + " through the admin API"
+	case !server.IsAlive():
+		return "failing health checks"
+	case server.Ejected():
+		return "ejected by outlier detection"
+	case server.Full():
+		return "at its connection limit"
+	case server.Breaker().State() == breakerOpen:
+		return "circuit breaker open"
+	case !server.Up():
+		return "circuit breaker half-open, trial requests in flight"
+	}
+	return ""
+}
+
+// circuitState is the breaker state of server, "" when it has none.
+func circuitState(server Server) string {
+	if server.Breaker() == nil {
+		return ""
+	}
+	return server.Breaker().State().String()
+}
+
+// adminServer exposes backend state, runtime controls and metrics on its
+// own listener, away from proxied traffic.
+type adminServer struct {
+	pools *poolRegistry
+	cache *responseCache
+}
+
+func (as *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /backends", as.listBackends)
+	mux.HandleFunc("POST /backends/enable", as.setState(stateEnabled))
+	mux.HandleFunc("POST /backends/disable", as.setState(stateDisabled))
+	mux.HandleFunc("POST /backends/drain", as.setState(stateDraining))
+	mux.HandleFunc("POST /cache/purge", as.purgeCache)
+	mux.HandleFunc("GET /metrics", as.metrics)
+	return mux
+}
+
+func (as *adminServer) listBackends(rw http.ResponseWriter, r *http.Request) {
+	statuses := []backendStatus{}
+	for _, p := range as.pools.all() {
+		for _, server := range p.servers {
+			statuses = append(statuses, newBackendStatus(p, server))
+		}
+	}
+	writeJSON(rw, http.StatusOK, statuses)
+}
+
+// setState handles POST /backends/<action>?pool=<name>&address=<backend>.
+// drain also takes a timeout, e.g. &timeout=2m, after which the requests
+// still running are cut off; it defaults to the configured drain_timeout.
+func (as *adminServer) setState(state adminState) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		poolName, address := r.URL.Query().Get("pool"), r.URL.Query().Get("address")
+		timeout := as.pools.drainTimeout()
+		if v := r.URL.Query().Get("timeout"); v != "" && state == stateDraining {
+			var err error
+			if timeout, err = time.ParseDuration(v); err != nil || timeout < 0 {
+				writeJSON(rw, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid timeout %q", v)})
+				return
+			}
+		}
+		p := as.pools.get(poolName)
+		if p == nil {
+			writeJSON(rw, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("unknown pool %q", poolName)})
+			return
+		}
+		for _, server := range p.servers {
+			if server.Address() == address {
+				if state == stateDraining {
+					server.Drain(timeout)
+				} else {
+					server.SetAdminState(state)
+				}
+				fmt.Printf("backend %q in pool %q is now %s\n", address, poolName, state)
+				writeJSON(rw, http.StatusOK, newBackendStatus(p, server))
+				return
+			}
+		}
+		writeJSON(rw, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("unknown backend %q in pool %q", address, poolName)})
+	}
+}
+
+func (as *adminServer) metrics(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.write(rw, as.pools.all())
+	as.cache.writeMetrics(rw)
+}
+
+// purgeCache handles POST /cache/purge?host=<host>&prefix=<path>, dropping
+// the cached responses that match both; without them the whole cache goes.
+func (as *adminServer) purgeCache(rw http.ResponseWriter, r *http.Request) {
+	host, prefix := r.URL.Query().Get("host"), r.URL.Query().Get("prefix")
+	purged := as.cache.purge(host, prefix)
+	fmt.Printf("purged %d cached responses\n", purged)
+	writeJSON(rw, http.StatusOK, map[string]int{"purged": purged})
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v any) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
+}
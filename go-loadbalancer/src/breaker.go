@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type breakerState int32
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// circuitBreaker guards one backend. While closed it counts failures over a
+// window and opens once their share reaches failureRatio. While open the
+// backend gets no traffic; after coolDown the breaker lets trialRequests
+// through and closes once they all succeed, or opens again on the first
+// failure. A nil *circuitBreaker is a breaker that is always closed.
+type circuitBreaker struct {
+	settings      breakerSettings
+	failureRatio  float64
+	minRequests   int64
+	window        time.Duration
+	coolDown      time.Duration
+	trialRequests int64
+	slowThreshold time.Duration // 0 means only errors count
+
+	state       atomic.Int32
+	since       atomic.Int64 // unix nanoseconds the state was entered
+	windowStart atomic.Int64
+	requests    atomic.Int64
+	failures    atomic.Int64
+	trials      atomic.Int64 // trials handed out in this half-open period
+	successes   atomic.Int64
+
+	mu sync.Mutex // serializes state changes, the closed path never takes it
+}
+
+// newCircuitBreaker returns nil when settings is nil, the breaker is off then.
+func newCircuitBreaker(settings *breakerSettings) *circuitBreaker {
+	if settings == nil {
+		return nil
+	}
+	cb := &circuitBreaker{
+		settings:      *settings,
+		failureRatio:  0.5,
+		minRequests:   20,
+		window:        10 * time.Second,
+		coolDown:      30 * time.Second,
+		trialRequests: 3,
+		slowThreshold: time.Duration(settings.SlowThreshold),
+	}
+	if settings.FailureRatio > 0 {
+		cb.failureRatio = settings.FailureRatio
+	}
+	if settings.MinRequests > 0 {
+		cb.minRequests = int64(settings.MinRequests)
+	}
+	if settings.Window > 0 {
+		cb.window = time.Duration(settings.Window)
+	}
+	if settings.CoolDown > 0 {
+		cb.coolDown = time.Duration(settings.CoolDown)
+	}
+	if settings.TrialRequests > 0 {
+		cb.trialRequests = int64(settings.TrialRequests)
+	}
+	now := time.Now().UnixNano()
+	cb.since.Store(now)
+	cb.windowStart.Store(now)
+	return cb
+}
+
+// configuredWith reports whether cb was built from settings, a reload keeps
+// the breaker and its state then.
+func (cb *circuitBreaker) configuredWith(settings *breakerSettings) bool {
+	if cb == nil || settings == nil {
+		return cb == nil && settings == nil
+	}
+	return cb.settings == *settings
+}
+
+// State is the current state, an open breaker whose cool-down has passed
+// already counts as half-open.
+func (cb *circuitBreaker) State() breakerState {
+	if cb == nil {
+		return breakerClosed
+	}
+	state := breakerState(cb.state.Load())
+	if state == breakerOpen && cb.elapsed() >= cb.coolDown {
+		return breakerHalfOpen
+	}
+	return state
+}
+
+// allow reports whether the backend may be picked for a request.
+func (cb *circuitBreaker) allow() bool {
+	if cb == nil {
+		return true
+	}
+	switch breakerState(cb.state.Load()) {
+	case breakerOpen:
+		if cb.elapsed() < cb.coolDown {
+			return false
+		}
+		cb.transition(breakerOpen, breakerHalfOpen)
+		return true
+	case breakerHalfOpen:
+		if cb.trials.Load() < cb.trialRequests {
+			return true
+		}
+		// trials that never reported back, e.g. because the client went
+		// away, would hold the breaker half-open forever
+		if cb.elapsed() >= cb.coolDown {
+			cb.transition(breakerHalfOpen, breakerHalfOpen)
+			return true
+		}
+		return false
+	}
+	return true
+}
+
+// wouldAllow reports what allow would without moving the breaker on, for
+// reporting the state.
+func (cb *circuitBreaker) wouldAllow() bool {
+	if cb == nil {
+		return true
+	}
+	switch breakerState(cb.state.Load()) {
+	case breakerOpen:
+		return cb.elapsed() >= cb.coolDown
+	case breakerHalfOpen:
+		return cb.trials.Load() < cb.trialRequests || cb.elapsed() >= cb.coolDown
+	}
+	return true
+}
+
+// acquire takes a trial slot when the breaker is half-open, it fails when
+// they are all taken or the breaker is open.
+func (cb *circuitBreaker) acquire() bool {
+	if cb == nil {
+		return true
+	}
+	switch breakerState(cb.state.Load()) {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		for {
+			n := cb.trials.Load()
+			if n >= cb.trialRequests {
+				return false
+			}
+			if cb.trials.CompareAndSwap(n, n+1) {
+				return true
+			}
+		}
+	}
+	return true
+}
+
+// observe records the outcome of a request. A response slower than the slow
+// threshold counts as a failure.
+func (cb *circuitBreaker) observe(address string, failed bool, latency time.Duration) {
+	if cb == nil {
+		return
+	}
+	if cb.slowThreshold > 0 && latency > cb.slowThreshold {
+		failed = true
+	}
+
+	switch breakerState(cb.state.Load()) {
+	case breakerClosed:
+		if start := cb.windowStart.Load(); time.Since(time.Unix(0, start)) > cb.window &&
+			cb.windowStart.CompareAndSwap(start, time.Now().UnixNano()) {
+			cb.requests.Store(0)
+			cb.failures.Store(0)
+		}
+		requests := cb.requests.Add(1)
+		failures := cb.failures.Load()
+		if failed {
+			failures = cb.failures.Add(1)
+		}
+		if requests >= cb.minRequests && float64(failures) >= cb.failureRatio*float64(requests) &&
+			cb.transition(breakerClosed, breakerOpen) {
+			fmt.Printf("circuit breaker of backend %q opened, %d of %d requests failed\n", address, failures, requests)
+		}
+	case breakerHalfOpen:
+		if failed {
+			if cb.transition(breakerHalfOpen, breakerOpen) {
+				fmt.Printf("circuit breaker of backend %q opened again, a trial request failed\n", address)
+			}
+			return
+		}
+		if cb.successes.Add(1) >= cb.trialRequests && cb.transition(breakerHalfOpen, breakerClosed) {
+			fmt.Printf("circuit breaker of backend %q closed\n", address)
+		}
+	}
+	// results that come in while open started before the breaker opened
+}
+
+// transition moves the breaker from one state to the next and resets the
+// counters of the new state. It reports false when another request changed
+// the state first.
+func (cb *circuitBreaker) transition(from breakerState, to breakerState) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if breakerState(cb.state.Load()) != from {
+		return false
+	}
+	if from == to && cb.elapsed() < cb.coolDown {
+		// another request restarted the half-open period already
+		return false
+	}
+	now := time.Now().UnixNano()
+	switch to {
+	case breakerClosed:
+		cb.windowStart.Store(now)
+		cb.requests.Store(0)
+		cb.failures.Store(0)
+	case breakerHalfOpen:
+		cb.trials.Store(0)
+		cb.successes.Store(0)
+	}
+	cb.since.Store(now)
+	cb.state.Store(int32(to))
+	return true
+}
+
+func (cb *circuitBreaker) elapsed() time.Duration {
+	return time.Since(time.Unix(0, cb.since.Load()))
+}
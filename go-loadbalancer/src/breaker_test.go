@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// openBreaker returns a breaker that has just opened.
+func openBreaker(t *testing.T, coolDown time.Duration) *circuitBreaker {
+	t.Helper()
+	cb := newCircuitBreaker(&breakerSettings{CoolDown: duration(coolDown), TrialRequests: 1})
+	if !cb.transition(breakerClosed, breakerOpen) {
+		t.Fatal("the breaker didn't open")
+	}
+	return cb
+}
+
+func TestBreakerUpChangesNothing(t *testing.T) {
+	server := testServers(1)[0]
+	cb := openBreaker(t, 20*time.Millisecond)
+	server.SetBreaker(cb)
+
+	if server.Up() || server.Available() {
+		t.Fatal("the server is available with its breaker open")
+	}
+	time.Sleep(30 * time.Millisecond)
+	for range 3 {
+		if !server.Up() {
+			t.Fatal("the server isn't up after the cool-down")
+		}
+	}
+	if state := breakerState(cb.state.Load()); state != breakerOpen {
+		t.Fatalf("reporting moved the breaker to %v", state)
+	}
+
+	// picking the server lets the trial requests through
+	if !server.Available() {
+		t.Fatal("the server isn't available after the cool-down")
+	}
+	if state := breakerState(cb.state.Load()); state != breakerHalfOpen {
+		t.Fatalf("picking left the breaker %v, want half-open", state)
+	}
+	if !cb.acquire() {
+		t.Fatal("no trial slot")
+	}
+	if server.Up() || server.Available() {
+		t.Fatal("the server is available with its only trial in flight")
+	}
+}
+
+func TestAdminReadsLeaveBreakerAlone(t *testing.T) {
+	pr := &poolRegistry{}
+	applyConfig(t, pr, testConfig(backendConfig{Address: "http://127.0.0.1:10001"}))
+	cb := openBreaker(t, time.Millisecond)
+	pr.get("web").servers[0].SetBreaker(cb)
+	time.Sleep(5 * time.Millisecond)
+
+	admin := (&adminServer{pools: pr, cache: newResponseCache(cacheSettings{})}).handler()
+	for _, path := range []string{"/backends", "/metrics"} {
+		rw := httptest.NewRecorder()
+		admin.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d", path, rw.Code)
+		}
+		if state := breakerState(cb.state.Load()); state != breakerOpen {
+			t.Fatalf("GET %s moved the breaker to %v", path, state)
+		}
+	}
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheableStatus lists the responses that may be stored, see RFC 9111.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// cacheEntry is one stored response.
+type cacheEntry struct {
+	key     string // primary key plus the values of the Vary headers
+	primary string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time // stale from then on, must be revalidated
+	size    int64
+}
+
+// cacheVariants are the entries stored for one URL, they differ in the
+// request headers named by the response's Vary header.
+type cacheVariants struct {
+	vary    []string
+	entries map[string]*list.Element
+}
+
+// responseCache is a shared HTTP cache in front of the backends. It keeps
+// responses in memory up to maxSize bytes and evicts the least recently used
+// ones first. Entries are looked up under a mutex, unlike the selection path
+// a cache lookup has to reorder the LRU list anyway.
+type responseCache struct {
+	maxSize      int64
+	maxEntrySize int64
+
+	mu   sync.Mutex
+	size int64
+	lru  *list.List                // of *cacheEntry, most recently used first
+	urls map[string]*cacheVariants // by primary key
+
+	hits, misses, revalidated atomic.Int64
+}
+
+func newResponseCache(settings cacheSettings) *responseCache {
+	rc := &responseCache{
+		maxSize:      64 << 20,
+		maxEntrySize: 1 << 20,
+		lru:          list.New(),
+		urls:         make(map[string]*cacheVariants),
+	}
+	if settings.MaxSize > 0 {
+		rc.maxSize = settings.MaxSize
+	}
+	if settings.MaxEntrySize > 0 {
+		rc.maxEntrySize = min(settings.MaxEntrySize, rc.maxSize)
+	}
+	return rc
+}
+
+// serve answers r from the cache when it holds a fresh response, otherwise
+// it calls forward and stores what comes back if the response allows it. A
+// stale response with a validator is revalidated with a conditional request
+// and served again when the backend answers 304.
+func (rc *responseCache) serve(rw http.ResponseWriter, r *http.Request, entry *accessEntry, forward http.HandlerFunc) {
+	if !cacheableRequest(r) {
+		entry.Cache = "BYPASS"
+		forward(rw, r)
+		return
+	}
+
+	primary := cacheKey(r)
+	reqCC := parseCacheControl(r.Header.Get("Cache-Control"))
+	cached := rc.get(primary, r)
+	if cached != nil && time.Now().Before(cached.expires) && !reqCC.has("no-cache") && reqCC["max-age"] != "0" {
+		rc.hits.Add(1)
+		entry.Cache = "HIT"
+		writeCached(rw, r, cached, "HIT")
+		return
+	}
+
+	rec := &cacheRecorder{ResponseWriter: rw, limit: rc.maxEntrySize}
+	out := r.WithContext(context.WithValue(r.Context(), backendHeaderKey{}, &rec.backendHeader))
+	if cached != nil && hasValidator(cached.header) {
+		rec.revalidating = true
+		out = out.Clone(out.Context())
+		out.Header.Del("If-None-Match")
+		out.Header.Del("If-Modified-Since")
+		if etag := cached.header.Get("ETag"); etag != "" {
+			out.Header.Set("If-None-Match", etag)
+		}
+		if lm := cached.header.Get("Last-Modified"); lm != "" {
+			out.Header.Set("If-Modified-Since", lm)
+		}
+	}
+	forward(rec, out)
+
+	if rec.notModified {
+		rc.revalidated.Add(1)
+		entry.Cache = "REVALIDATED"
+		refreshed := rc.refresh(cached, rec.header)
+		writeCached(rw, r, refreshed, "REVALIDATED")
+		return
+	}
+	rc.misses.Add(1)
+	entry.Cache = "MISS"
+	if rec.store && !rec.tooBig && r.Method == http.MethodGet && r.Context().Err() == nil {
+		rc.put(primary, r, rec.status, rec.header, rec.body.Bytes())
+	}
+}
+
+// get returns the entry stored for r, fresh or not, or nil.
+func (rc *responseCache) get(primary string, r *http.Request) *cacheEntry {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	variants, ok := rc.urls[primary]
+	if !ok {
+		return nil
+	}
+	el, ok := variants.entries[variantKey(primary, variants.vary, r)]
+	if !ok {
+		return nil
+	}
+	rc.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry)
+}
+
+// put stores a response when its Cache-Control allows a shared cache to.
+func (rc *responseCache) put(primary string, r *http.Request, status int, header http.Header, body []byte) {
+	ttl, ok := freshness(status, header)
+	if !ok {
+		return
+	}
+	vary := varyHeaders(header)
+	if slices.Contains(vary, "*") {
+		return
+	}
+
+	now := time.Now()
+	e := &cacheEntry{
+		key:     variantKey(primary, vary, r),
+		primary: primary,
+		status:  status,
+		header:  storedHeader(header),
+		body:    slices.Clone(body),
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+	e.size = int64(len(e.key) + len(e.body))
+	for k, v := range e.header {
+		e.size += int64(len(k))
+		for _, s := range v {
+			e.size += int64(len(s))
+		}
+	}
+	if e.size > rc.maxEntrySize {
+		return
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	variants, ok := rc.urls[primary]
+	if !ok || !slices.Equal(variants.vary, vary) {
+		// a new Vary makes the old variants unreachable
+		if ok {
+			rc.removeURL(primary)
+		}
+		variants = &cacheVariants{vary: vary, entries: make(map[string]*list.Element)}
+		rc.urls[primary] = variants
+	}
+	if old, ok := variants.entries[e.key]; ok {
+		rc.remove(old)
+	}
+	variants.entries[e.key] = rc.lru.PushFront(e)
+	rc.size += e.size
+	for rc.size > rc.maxSize {
+		rc.remove(rc.lru.Back())
+	}
+}
+
+// refresh updates a revalidated entry with the headers of the 304 and
+// restarts its freshness, it returns the entry to serve.
+func (rc *responseCache) refresh(e *cacheEntry, notModified http.Header) *cacheEntry {
+	header := e.header.Clone()
+	for _, name := range []string{"Cache-Control", "Date", "ETag", "Expires", "Last-Modified", "Vary"} {
+		if v, ok := notModified[name]; ok {
+			header[name] = slices.Clone(v)
+		}
+	}
+	ttl, _ := freshness(e.status, header)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	// entries are shared with concurrent readers, replace the fields that
+	// change under the lock and hand out a copy
+	next := *e
+	next.header = header
+	next.stored = time.Now()
+	next.expires = next.stored.Add(ttl)
+	if variants, ok := rc.urls[e.primary]; ok {
+		if el, ok := variants.entries[e.key]; ok && el.Value == e {
+			el.Value = &next
+		}
+	}
+	return &next
+}
+
+// purge drops the entries whose host matches host and whose path starts with
+// prefix, empty values match everything. It returns how many were dropped.
+func (rc *responseCache) purge(host string, prefix string) int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	purged := 0
+	for primary, variants := range rc.urls {
+		h, uri, _ := strings.Cut(primary, " ")
+		if (host == "" || strings.EqualFold(h, host)) && strings.HasPrefix(uri, prefix) {
+			purged += len(variants.entries)
+			rc.removeURL(primary)
+		}
+	}
+	return purged
+}
+
+func (rc *responseCache) removeURL(primary string) {
+	for _, el := range rc.urls[primary].entries {
+		rc.remove(el)
+	}
+	delete(rc.urls, primary)
+}
+
+// remove drops one entry, the caller holds mu.
+func (rc *responseCache) remove(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	rc.lru.Remove(el)
+	rc.size -= e.size
+	if variants, ok := rc.urls[e.primary]; ok {
+		delete(variants.entries, e.key)
+		if len(variants.entries) == 0 {
+			delete(rc.urls, e.primary)
+		}
+	}
+}
+
+// stats returns the number of entries and the bytes they take.
+func (rc *responseCache) stats() (entries int, size int64) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.lru.Len(), rc.size
+}
+
+// writeMetrics adds the cache counters to the Prometheus output.
+func (rc *responseCache) writeMetrics(w io.Writer) {
+	entries, size := rc.stats()
+	fmt.Fprintln(w, "# HELP lb_cache_requests_total Cacheable requests by outcome.")
+	fmt.Fprintln(w, "# TYPE lb_cache_requests_total counter")
+	fmt.Fprintf(w, "lb_cache_requests_total{result=\"hit\"} %d\n", rc.hits.Load())
+	fmt.Fprintf(w, "lb_cache_requests_total{result=\"miss\"} %d\n", rc.misses.Load())
+	fmt.Fprintf(w, "lb_cache_requests_total{result=\"revalidated\"} %d\n", rc.revalidated.Load())
+	fmt.Fprintln(w, "# HELP lb_cache_entries Responses held by the cache.")
+	fmt.Fprintln(w, "# TYPE lb_cache_entries gauge")
+	fmt.Fprintf(w, "lb_cache_entries %d\n", entries)
+	fmt.Fprintln(w, "# HELP lb_cache_bytes Memory taken by the cached responses.")
+	fmt.Fprintln(w, "# TYPE lb_cache_bytes gauge")
+	fmt.Fprintf(w, "lb_cache_bytes %d\n", size)
+}
+
+// writeCached answers r with a stored response, or with a 304 when the
+// client's own validators still match it.
+func writeCached(rw http.ResponseWriter, r *http.Request, e *cacheEntry, result string) {
+	header := rw.Header()
+	for k, v := range e.header {
+		header[k] = slices.Clone(v)
+	}
+	header.Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+	header.Set("X-Cache", result)
+
+	if notModifiedFor(r, e.header) {
+		header.Del("Content-Length")
+		header.Del("Content-Type")
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	rw.WriteHeader(e.status)
+	if r.Method != http.MethodHead {
+		rw.Write(e.body)
+	}
+}
+
+// backendHeaderKey carries a pointer to an http.Header through the request
+// context, the proxy stores the headers of the backend's response there.
+type backendHeaderKey struct{}
+
+// cacheRecorder sits between the backend and the client while a cacheable
+// request is forwarded. It copies the body aside for storing and, when the
+// request is a revalidation, swallows the backend's 304 so the cached
+// response can be served instead.
+type cacheRecorder struct {
+	http.ResponseWriter
+	revalidating bool
+	limit        int64
+
+	// the writer's header also holds what the load balancer adds itself,
+	// the request ID and a sticky cookie, only the backend's part is stored
+	backendHeader http.Header
+
+	status      int
+	header      http.Header // the backend's
+	notModified bool
+	store       bool // the response may be stored
+	tooBig      bool
+	body        bytes.Buffer
+}
+
+func (cr *cacheRecorder) WriteHeader(status int) {
+	if status < 200 || cr.status != 0 {
+		cr.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cr.status = status
+	cr.header = cr.backendHeader
+	if cr.header == nil {
+		// an error of the load balancer's own
+		cr.header = http.Header{}
+	}
+	if cr.revalidating && status == http.StatusNotModified {
+		cr.notModified = true
+		header := cr.ResponseWriter.Header()
+		for k, v := range cr.header {
+			header[k] = slices.DeleteFunc(header[k], func(s string) bool {
+				return slices.Contains(v, s)
+			})
+			if len(header[k]) == 0 {
+				delete(header, k)
+			}
+		}
+		return
+	}
+	_, cr.store = freshness(status, cr.header)
+	cr.ResponseWriter.Header().Set("X-Cache", "MISS")
+	cr.ResponseWriter.WriteHeader(status)
+}
+
+func (cr *cacheRecorder) Write(b []byte) (int, error) {
+	if cr.status == 0 {
+		cr.WriteHeader(http.StatusOK)
+	}
+	if cr.notModified {
+		return len(b), nil
+	}
+	if cr.store && !cr.tooBig {
+		if int64(cr.body.Len()+len(b)) > cr.limit {
+			cr.tooBig = true
+			cr.body = bytes.Buffer{}
+		} else {
+			cr.body.Write(b)
+		}
+	}
+	return cr.ResponseWriter.Write(b)
+}
+
+func (cr *cacheRecorder) Unwrap() http.ResponseWriter {
+	return cr.ResponseWriter
+}
+
+// cacheableRequest reports whether r may be answered from the cache. Anything
+// carrying credentials, asking for a range or upgrading the connection goes
+// straight to the backend.
+func cacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Range") != "" || r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	return !parseCacheControl(r.Header.Get("Cache-Control")).has("no-store")
+}
+
+// cacheKey is the host and the request URI, GET and HEAD share entries.
+func cacheKey(r *http.Request) string {
+	return strings.ToLower(r.Host) + " " + r.URL.RequestURI()
+}
+
+func variantKey(primary string, vary []string, r *http.Request) string {
+	if len(vary) == 0 {
+		return primary
+	}
+	var b strings.Builder
+	b.WriteString(primary)
+	for _, name := range vary {
+		b.WriteByte('\n')
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+// varyHeaders returns the canonical names listed by Vary, sorted so the same
+// set always makes the same key.
+func varyHeaders(header http.Header) []string {
+	var names []string
+	for _, v := range header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// freshness returns how long a response stays fresh and whether a shared
+// cache may store it at all. A response without explicit freshness is only
+// stored when it has a validator, it is revalidated on every use then.
+func freshness(status int, header http.Header) (time.Duration, bool) {
+	cc := parseCacheControl(header.Get("Cache-Control"))
+	if !cacheableStatus[status] || cc.has("no-store") || cc.has("private") || header.Get("Set-Cookie") != "" {
+		return 0, false
+	}
+
+	var ttl time.Duration
+	if v, ok := cc["s-maxage"]; ok {
+		ttl = parseSeconds(v)
+	} else if v, ok := cc["max-age"]; ok {
+		ttl = parseSeconds(v)
+	} else if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		ttl = expires.Sub(date)
+	}
+	if age := parseSeconds(header.Get("Age")); age > 0 {
+		ttl -= age
+	}
+	if cc.has("no-cache") {
+		ttl = 0
+	}
+	if ttl <= 0 {
+		return 0, hasValidator(header)
+	}
+	return ttl, true
+}
+
+func hasValidator(header http.Header) bool {
+	return header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+}
+
+// notModifiedFor reports whether the client already holds the response
+// described by header, going by If-None-Match or else If-Modified-Since.
+func notModifiedFor(r *http.Request, header http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+// storedHeader is the part of a response header worth keeping: hop-by-hop
+// headers and the request ID belong to the request that fetched it.
+func storedHeader(header http.Header) http.Header {
+	stored := header.Clone()
+	for _, name := range []string{"Connection", "Keep-Alive", "Transfer-Encoding", "Trailer", "Age", "X-Cache", requestIDHeader} {
+		stored.Del(name)
+	}
+	return stored
+}
+
+// cacheControl holds the directives of a Cache-Control header, lower-cased,
+// with "" as the value of those without one.
+type cacheControl map[string]string
+
+func parseCacheControl(v string) cacheControl {
+	cc := cacheControl{}
+	for _, directive := range strings.Split(v, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if name != "" {
+			cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+func parseSeconds(v string) time.Duration {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestCacheKeepsOwnHeaders sends requests of new clients through the cache to
+// a pool with sticky cookies. The sticky cookie doesn't keep the response
+// from being stored, and a revalidation drops the headers of the backend's
+// 304 but not those of the load balancer.
+func TestCacheKeepsOwnHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("ETag", `"v1"`)
+		rw.Header().Set("Cache-Control", "max-age=0")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			rw.Header().Set("X-Revalidation", "yes")
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rw.Header().Set("X-Origin", "yes")
+		rw.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	pr := &poolRegistry{}
+	cfg := testConfig(backendConfig{Address: backend.URL})
+	cfg.Pools[0].Sticky = stickySettings{Mode: "cookie"}
+	applyConfig(t, pr, cfg)
+	p := pr.get("web")
+	lb := &loadBalancer{port: "8080", pools: pr}
+	rc := newResponseCache(cacheSettings{})
+
+	get := func() *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://lb/page", nil)
+		rw.Header().Set(requestIDHeader, ensureRequestID(r))
+		rc.serve(rw, r, &accessEntry{}, func(rw http.ResponseWriter, r *http.Request) {
+			lb.forward(rw, r, p, &accessEntry{})
+		})
+		return rw
+	}
+
+	first := get()
+	if got := first.Header().Get("X-Cache"); got != "MISS" {
+		t.Fatalf("first request: X-Cache %q, want MISS", got)
+	}
+	if entries, _ := rc.stats(); entries != 1 {
+		t.Fatalf("%d entries after the first request of a new client, want 1", entries)
+	}
+
+	second := get()
+	if got := second.Header().Get("X-Cache"); got != "REVALIDATED" {
+		t.Fatalf("second request: X-Cache %q, want REVALIDATED", got)
+	}
+	if second.Code != http.StatusOK || second.Body.String() != "hello" {
+		t.Fatalf("revalidated response: %d %q, want the stored 200 hello", second.Code, second.Body)
+	}
+	if !strings.HasPrefix(second.Header().Get("Set-Cookie"), "lb_sticky=") {
+		t.Fatalf("revalidated response sets cookie %q, want the sticky one", second.Header().Get("Set-Cookie"))
+	}
+	if second.Header().Get(requestIDHeader) == "" {
+		t.Fatal("revalidated response has no request ID")
+	}
+	if second.Header().Get("X-Revalidation") != "" {
+		t.Fatal("revalidated response carries the headers of the backend's 304")
+	}
+	if second.Header().Get("X-Origin") != "yes" {
+		t.Fatal("revalidated response lost the stored headers")
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// config is the on-disk description of the load balancer, see
+// config.example.json for a complete file.
+type config struct {
+	Admin        adminConfig       `json:"admin"`
+	Listeners    []listenerConfig  `json:"listeners"`
+	Pools        []poolConfig      `json:"pools"`
+	DrainTimeout duration          `json:"drain_timeout"`
+	AccessLog    accessLogSettings `json:"access_log"`
+	Cache        cacheSettings     `json:"cache"`
+}
+
+// adminConfig enables the admin API when Address is set, e.g.
+// "127.0.0.1:9090". Like the listeners it can't change on reload.
+type adminConfig struct {
+	Address string `json:"address"`
+}
+
+// accessLogSettings writes the access log as "json" (the default), in the
+// "common" log format or not at all with "off". Path is a file to append to,
+// stdout when empty. Like the listeners it can't change on reload.
+type accessLogSettings struct {
+	Format string `json:"format"`
+	Path   string `json:"path"`
+}
+
+// cacheSettings sizes the response cache shared by the routes that turn
+// caching on: MaxSize bytes in all (default 64 MiB) and MaxEntrySize bytes
+// per response (default 1 MiB). Like the listeners it can't change on
+// reload.
+type cacheSettings struct {
+	MaxSize      int64 `json:"max_size"`
+	MaxEntrySize int64 `json:"max_entry_size"`
+}
+
+// listenerConfig binds a port. Requests go to the pool of the first matching
+// route, or to Pool when no route matches; Cache turns on response caching
+// for the latter. A "tcp" or "udp" Mode passes connections through to Pool
+// without parsing HTTP.
+type listenerConfig struct {
+	Port        string             `json:"port"`
+	Mode        string             `json:"mode"`
+	IdleTimeout duration           `json:"idle_timeout"` // UDP sessions, default 1m
+	Pool        string             `json:"pool"`
+	Routes      []routeConfig      `json:"routes"`
+	TLS         *listenerTLS       `json:"tls"`
+	RateLimit   *rateLimitSettings `json:"rate_limit"`
+	Cache       bool               `json:"cache"`
+}
+
+// routeConfig matches on every condition that is set. Cache serves the
+// route's GET and HEAD requests from the response cache where the backend
+// allows it.
+type routeConfig struct {
+	Host       string            `json:"host"`
+	PathPrefix string            `json:"path_prefix"`
+	Methods    []string          `json:"methods"`
+	Headers    map[string]string `json:"headers"`
+	Pool       string            `json:"pool"`
+	Cache      bool              `json:"cache"`
+}
+
+type poolConfig struct {
+	Name             string              `json:"name"`
+	Strategy         string              `json:"strategy"`
+	HashOn           string              `json:"hash_on"`
+	Backends         []backendConfig     `json:"backends"`
+	HealthCheck      healthCheckSettings `json:"health_check"`
+	Retry            retrySettings       `json:"retry"`
+	OutlierDetection outlierSettings     `json:"outlier_detection"`
+	Sticky           stickySettings      `json:"sticky"`
+	TLS              *backendTLS         `json:"tls"`
+	Queue            queueSettings       `json:"queue"`
+	CircuitBreaker   *breakerSettings    `json:"circuit_breaker"`
+}
+
+type backendConfig struct {
+	Address        string `json:"address"`
+	Weight         int    `json:"weight"`
+	MaxConnections int    `json:"max_connections"`
+}
+
+// healthCheckSettings probes with Type "http", "tcp" (connect only) or
+// "none". It defaults to "http" for HTTP backends, "tcp" for tcp:// backends
+// and "none" for udp:// ones, which can't be probed without a protocol.
+type healthCheckSettings struct {
+	Type               string   `json:"type"`
+	Path               string   `json:"path"`
+	Interval           duration `json:"interval"`
+	Timeout            duration `json:"timeout"`
+	HealthyThreshold   int      `json:"healthy_threshold"`
+	UnhealthyThreshold int      `json:"unhealthy_threshold"`
+}
+
+// retrySettings leaves Attempts nil to get the default of one retry, 0
+// turns retrying off.
+type retrySettings struct {
+	Attempts    *int    `json:"attempts"`
+	BudgetRatio float64 `json:"budget_ratio"`
+}
+
+// outlierSettings leaves ConsecutiveErrors nil to get the default of 5, 0
+// turns passive outlier detection off.
+type outlierSettings struct {
+	ConsecutiveErrors  *int     `json:"consecutive_errors"`
+	EjectionDuration   duration `json:"ejection_duration"`
+	MaxEjectionPercent int      `json:"max_ejection_percent"`
+}
+
+// breakerSettings turns on a circuit breaker for every backend of a pool. It
+// opens when FailureRatio (default 0.5) of at least MinRequests (default 20)
+// requests within Window (default 10s) fail or take longer than
+// SlowThreshold to answer, and sends TrialRequests (default 3) after
+// CoolDown (default 30s).
+type breakerSettings struct {
+	FailureRatio  float64  `json:"failure_ratio"`
+	MinRequests   int      `json:"min_requests"`
+	Window        duration `json:"window"`
+	CoolDown      duration `json:"cool_down"`
+	TrialRequests int      `json:"trial_requests"`
+	SlowThreshold duration `json:"slow_threshold"`
+}
+
+// stickySettings turns on session affinity when Mode is "cookie" or "ip".
+type stickySettings struct {
+	Mode       string   `json:"mode"`
+	CookieName string   `json:"cookie_name"`
+	TTL        duration `json:"ttl"`
+}
+
+// rateLimitSettings allows Rate requests per second with bursts of Burst per
+// Key, which is "ip", "header:<name>" or "route".
+type rateLimitSettings struct {
+	Key   string  `json:"key"`
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// queueSettings lets up to Size requests wait for a backend that is at its
+// connection limit, for at most Timeout (default 5s).
+type queueSettings struct {
+	Size    int      `json:"size"`
+	Timeout duration `json:"timeout"`
+}
+
+// duration lets durations be written as "10s" or "500ms" in the config file.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// defaultConfig is used when no config file is given.
+func defaultConfig() *config {
+	return &config{
+		Listeners: []listenerConfig{{Port: "8080", Pool: "default"}},
+		Pools: []poolConfig{{
+			Name:     "default",
+			Strategy: "round_robin",
+			Backends: []backendConfig{
+				{Address: "https://www.facebook.com", Weight: 1},
+				{Address: "https://github.com/dev-kumaralingam", Weight: 1},
+				{Address: "https://github.com/dev-dhanushkumar", Weight: 1},
+			},
+		}},
+	}
+}
+
+func loadConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// ports lists the listener ports, these can't change on reload.
+func (cfg *config) ports() []string {
+	ports := make([]string, len(cfg.Listeners))
+	for i, l := range cfg.Listeners {
+		ports[i] = l.Port
+	}
+	return ports
+}
+
+// drainTimeout is how long draining backends and a shutdown wait for
+// requests in flight, 30s unless configured.
+func (cfg *config) drainTimeout() time.Duration {
+	if cfg.DrainTimeout > 0 {
+		return time.Duration(cfg.DrainTimeout)
+	}
+	return defaultDrainTimeout
+}
+
+func (cfg *config) validate() error {
+	if len(cfg.Listeners) == 0 {
+		return fmt.Errorf("at least one listener is required")
+	}
+	switch cfg.AccessLog.Format {
+	case "", "json", "common", "off":
+	default:
+		return fmt.Errorf("unknown access_log format %q", cfg.AccessLog.Format)
+	}
+
+	pools := make(map[string]bool)
+	for _, p := range cfg.Pools {
+		if p.Name == "" {
+			return fmt.Errorf("pool without a name")
+		}
+		if pools[p.Name] {
+			return fmt.Errorf("pool %q defined twice", p.Name)
+		}
+		pools[p.Name] = true
+
+		if len(p.Backends) == 0 {
+			return fmt.Errorf("pool %q has no backends", p.Name)
+		}
+		for _, b := range p.Backends {
+			u, err := url.Parse(b.Address)
+			if err != nil || u.Host == "" || backendNetwork(u.Scheme) == "" {
+				return fmt.Errorf("pool %q: invalid backend address %q", p.Name, b.Address)
+			}
+			if backendNetwork(u.Scheme) != "http" && u.Port() == "" {
+				return fmt.Errorf("pool %q: backend address %q needs a port", p.Name, b.Address)
+			}
+			if backendNetwork(u.Scheme) != p.network() {
+				return fmt.Errorf("pool %q: can't mix %s and %s backends", p.Name, backendNetwork(u.Scheme), p.network())
+			}
+		}
+		switch p.HealthCheck.Type {
+		case "", "tcp", "none":
+		case "http":
+			if p.network() != "http" {
+				return fmt.Errorf("pool %q: http health checks need http backends", p.Name)
+			}
+		default:
+			return fmt.Errorf("pool %q: unknown health check type %q", p.Name, p.HealthCheck.Type)
+		}
+		if _, err := newStrategy(p.Strategy, p.HashOn); err != nil {
+			return fmt.Errorf("pool %q: %w", p.Name, err)
+		}
+		if _, _, err := p.TLS.transport(); err != nil {
+			return fmt.Errorf("pool %q: %w", p.Name, err)
+		}
+		if cb := p.CircuitBreaker; cb != nil && (cb.FailureRatio < 0 || cb.FailureRatio > 1) {
+			return fmt.Errorf("pool %q: circuit_breaker failure_ratio must be between 0 and 1", p.Name)
+		}
+		switch p.Sticky.Mode {
+		case "", "cookie", "ip":
+		default:
+			return fmt.Errorf("pool %q: unknown sticky mode %q", p.Name, p.Sticky.Mode)
+		}
+	}
+
+	ports := make(map[string]bool)
+	for _, l := range cfg.Listeners {
+		if l.Port == "" {
+			return fmt.Errorf("listener without a port")
+		}
+		if ports[l.Port] {
+			return fmt.Errorf("listener %s defined twice", l.Port)
+		}
+		ports[l.Port] = true
+
+		if l.Mode == "tcp" || l.Mode == "udp" {
+			if err := l.validatePassthrough(cfg); err != nil {
+				return fmt.Errorf("listener %s: %w", l.Port, err)
+			}
+			continue
+		}
+		if l.Mode != "" && l.Mode != "http" {
+			return fmt.Errorf("listener %s: unknown mode %q", l.Port, l.Mode)
+		}
+		names := []string{l.Pool}
+		for _, rc := range l.Routes {
+			names = append(names, rc.Pool)
+		}
+		for _, name := range names {
+			if pc := cfg.pool(name); pc != nil && pc.network() != "http" {
+				return fmt.Errorf("listener %s: pool %q has %s backends, use %s mode", l.Port, name, pc.network(), pc.network())
+			}
+		}
+
+		if l.Pool == "" && len(l.Routes) == 0 {
+			return fmt.Errorf("listener %s needs a pool or routes", l.Port)
+		}
+		if l.Pool != "" && !pools[l.Pool] {
+			return fmt.Errorf("listener %s: unknown pool %q", l.Port, l.Pool)
+		}
+		for _, rc := range l.Routes {
+			if !pools[rc.Pool] {
+				return fmt.Errorf("listener %s: route to unknown pool %q", l.Port, rc.Pool)
+			}
+		}
+		if l.TLS != nil {
+			if _, err := l.TLS.config(); err != nil {
+				return fmt.Errorf("listener %s: %w", l.Port, err)
+			}
+		}
+		if rl := l.RateLimit; rl != nil {
+			source, name, _ := strings.Cut(rl.Key, ":")
+			switch {
+			case rl.Rate <= 0:
+				return fmt.Errorf("listener %s: rate_limit needs a positive rate", l.Port)
+			case source == "header" && name == "":
+				return fmt.Errorf("listener %s: rate_limit key %q needs a header name", l.Port, rl.Key)
+			case source != "" && source != "ip" && source != "header" && source != "route":
+				return fmt.Errorf("listener %s: unknown rate_limit key %q", l.Port, rl.Key)
+			}
+		}
+	}
+	return nil
+}
+
+// validatePassthrough checks a "tcp" or "udp" listener, which forwards bytes
+// to a single pool and leaves everything HTTP aside.
+func (l listenerConfig) validatePassthrough(cfg *config) error {
+	switch {
+	case l.Pool == "":
+		return fmt.Errorf("%s mode needs a pool", l.Mode)
+	case len(l.Routes) > 0 || l.TLS != nil || l.RateLimit != nil || l.Cache:
+		return fmt.Errorf("routes, tls, rate_limit and cache need http mode")
+	}
+	pc := cfg.pool(l.Pool)
+	if pc == nil {
+		return fmt.Errorf("unknown pool %q", l.Pool)
+	}
+	switch {
+	case l.Mode == "udp" && pc.network() != "udp":
+		return fmt.Errorf("pool %q needs udp:// backends", pc.Name)
+	case l.Mode == "tcp" && pc.network() == "udp":
+		return fmt.Errorf("pool %q has udp backends", pc.Name)
+	case pc.Sticky.Mode == "cookie":
+		return fmt.Errorf("pool %q: cookie sticky sessions need http mode", pc.Name)
+	case pc.TLS != nil:
+		return fmt.Errorf("pool %q: backend tls needs http mode, %s mode passes TLS through", pc.Name, l.Mode)
+	}
+	return nil
+}
+
+func (cfg *config) pool(name string) *poolConfig {
+	for i := range cfg.Pools {
+		if cfg.Pools[i].Name == name {
+			return &cfg.Pools[i]
+		}
+	}
+	return nil
+}
+
+// network is "http", "tcp" or "udp" after the scheme of the pool's backends.
+func (pc *poolConfig) network() string {
+	if len(pc.Backends) == 0 {
+		return "http"
+	}
+	u, err := url.Parse(pc.Backends[0].Address)
+	if err != nil {
+		return "http"
+	}
+	return backendNetwork(u.Scheme)
+}
+
+func backendNetwork(scheme string) string {
+	switch scheme {
+	case "http", "https":
+		return "http"
+	case "tcp", "udp":
+		return scheme
+	}
+	return ""
+}
+
+// healthCheck converts the JSON settings, filling in defaults for anything
+// left out. network is that of the pool's backends.
+func (hc healthCheckSettings) healthCheck(network string) healthCheckConfig {
+	config := defaultHealthCheckConfig()
+	switch {
+	case hc.Type != "":
+		config.kind = hc.Type
+	case network == "tcp":
+		config.kind = "tcp"
+	case network == "udp":
+		config.kind = "none"
+	}
+	if hc.Path != "" {
+		config.path = hc.Path
+	}
+	if hc.Interval > 0 {
+		config.interval = time.Duration(hc.Interval)
+	}
+	if hc.Timeout > 0 {
+		config.timeout = time.Duration(hc.Timeout)
+	}
+	if hc.HealthyThreshold > 0 {
+		config.healthyThreshold = hc.HealthyThreshold
+	}
+	if hc.UnhealthyThreshold > 0 {
+		config.unhealthyThreshold = hc.UnhealthyThreshold
+	}
+	return config
+}
+
+func (rs retrySettings) policy() *retryPolicy {
+	attempts, ratio := 1, 0.2
+	if rs.Attempts != nil {
+		attempts = *rs.Attempts
+	}
+	if rs.BudgetRatio > 0 {
+		ratio = rs.BudgetRatio
+	}
+	return &retryPolicy{attempts: attempts, budget: newRetryBudget(ratio)}
+}
+
+// newStrategy builds a Strategy from its config name. hashOn is only used by
+// consistent_hash and is either "ip", "header:<name>" or "cookie:<name>".
+func newStrategy(name string, hashOn string) (Strategy, error) {
+	switch name {
+	case "", "round_robin":
+		return &roundRobin{}, nil
+	case "weighted_round_robin":
+		return &weightedRoundRobin{}, nil
+	case "least_connections":
+		return leastConnections{}, nil
+	case "random_two_choices":
+		return randomTwoChoices{}, nil
+	case "consistent_hash":
+		source, name, _ := strings.Cut(hashOn, ":")
+		switch source {
+		case "", "ip":
+			return &consistentHash{source: "ip"}, nil
+		case "header", "cookie":
+			if name == "" {
+				return nil, fmt.Errorf("hash_on %q needs a name", hashOn)
+			}
+			return &consistentHash{source: source, name: name}, nil
+		}
+		return nil, fmt.Errorf("unknown hash_on %q", hashOn)
+	}
+	return nil, fmt.Errorf("unknown strategy %q", name)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errNoBackend     = errors.New("no backend available")
+	errBackendsFull  = errors.New("backends at capacity")
+	errQueueTimedOut = errors.New("timed out waiting for a backend")
+)
+
+// connQueue holds requests waiting for a backend of a pool to free a
+// connection slot. Every released slot wakes at most one waiter.
+type connQueue struct {
+	size    int64 // 0 disables queueing
+	timeout time.Duration
+	waiting atomic.Int64
+	freed   chan struct{}
+}
+
+func newConnQueue(settings queueSettings) *connQueue {
+	q := &connQueue{
+		size:    int64(settings.Size),
+		timeout: 5 * time.Second,
+	}
+	if settings.Timeout > 0 {
+		q.timeout = time.Duration(settings.Timeout)
+	}
+	q.freed = make(chan struct{}, max(q.size, 1))
+	return q
+}
+
+// signal tells one waiter that a slot was released.
+func (q *connQueue) signal() {
+	select {
+	case q.freed <- struct{}{}:
+	default:
+	}
+}
+
+// acquire picks a server for r and reserves a connection slot on it. When
+// every usable server, or the server the client is pinned to, is at its
+// connection limit the request waits in the pool's queue until a slot frees
+// up, the queue timeout passes or the client goes away. The caller must call release once it is done with the server.
+func (p *pool) acquire(rw http.ResponseWriter, r *http.Request, exclude ...Server) (Server, error) {
+	var timeout <-chan time.Time
+	for {
+		server, pinned := p.pick(rw, r, exclude...)
+		if server != nil && server.Acquire() {
+			return server, nil
+		}
+		if server != nil && !pinned {
+			// another request took the last slot in the meantime
+			continue
+		}
+
+		// a client keeps its pinned server when that is only busy
+		if !pinned && !p.atCapacity(exclude) {
+			return nil, errNoBackend
+		}
+		if p.queue.waiting.Add(1) > p.queue.size {
+			p.queue.waiting.Add(-1)
+			return nil, errBackendsFull
+		}
+		if timeout == nil {
+			timer := time.NewTimer(p.queue.timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case <-p.queue.freed:
+			p.queue.waiting.Add(-1)
+		case <-timeout:
+			p.queue.waiting.Add(-1)
+			return nil, errQueueTimedOut
+		case <-r.Context().Done():
+			p.queue.waiting.Add(-1)
+			return nil, r.Context().Err()
+		}
+	}
+}
+
+func (p *pool) release(server Server) {
+	server.Release()
+	p.queue.signal()
+}
+
+// atCapacity reports whether a server that is otherwise usable is only held
+// back by its connection limit, waiting for it is worth it then.
+func (p *pool) atCapacity(exclude []Server) bool {
+	for _, server := range p.servers {
+		if server.Full() && usable(server) && !slices.Contains(exclude, server) {
+			return true
+		}
+	}
+	return false
+}
+
+// usable reports whether server would be available if it had a free
+// connection slot.
+func usable(server Server) bool {
+	return server.AdminState() == stateEnabled && server.IsAlive() && !server.Ejected() && server.Breaker().allow()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const defaultDrainTimeout = 30 * time.Second
+
+var errDrained = errors.New("cut off by the drain deadline")
+
+// cutoff is shared by the requests a server is serving, cancelling it ends
+// them all. A server gets a fresh one whenever a drain is called off.
+type cutoff struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newCutoff() *cutoff {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &cutoff{ctx: ctx, cancel: cancel}
+}
+
+// retire drains the servers of the previous generation that the new one no
+// longer uses, so their requests finish instead of running forever.
+func retire(old map[string]*pool, next map[string]*pool, timeout time.Duration) {
+	kept := make(map[Server]bool)
+	for _, p := range next {
+		for _, server := range p.servers {
+			kept[server] = true
+		}
+	}
+	for _, p := range old {
+		for _, server := range p.servers {
+			if !kept[server] {
+				server.Drain(timeout)
+			}
+		}
+	}
+}
+
+// listener is what a shutdown stops: an *http.Server or a passthrough proxy.
+type listener interface {
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+// shutdown stops the listeners from accepting connections and waits for the
+// requests in flight, upgraded connections included, for up to timeout.
+// Whatever is still running then is cut off.
+func shutdown(servers []listener, pools *poolRegistry, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// backends stay available meanwhile: a keep-alive connection may still
+	// deliver a request before it is closed
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				srv.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Shutdown doesn't wait for hijacked connections, nor for passthrough
+	// connections once it timed out; the in-flight counters of the backends
+	// still cover them
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for inFlight(pools) > 0 {
+		select {
+		case <-ctx.Done():
+			fmt.Printf("drain deadline passed, cutting off %d requests\n", inFlight(pools))
+			for _, p := range pools.all() {
+				for _, server := range p.servers {
+					server.Drain(0)
+				}
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func inFlight(pools *poolRegistry) int64 {
+	var n int64
+	for _, p := range pools.all() {
+		for _, server := range p.servers {
+			n += server.InFlight()
+		}
+	}
+	return n
+}
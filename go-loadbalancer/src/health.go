@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// healthCheckConfig describes how backends are actively probed.
+type healthCheckConfig struct {
+	kind               string // "http", "tcp" or "none"
+	path               string
+	interval           time.Duration
+	timeout            time.Duration
+	healthyThreshold   int // consecutive successes before a backend is readmitted
+	unhealthyThreshold int // consecutive failures before a backend is ejected
+}
+
+func defaultHealthCheckConfig() healthCheckConfig {
+	return healthCheckConfig{
+		kind:               "http",
+		path:               "/",
+		interval:           10 * time.Second,
+		timeout:            2 * time.Second,
+		healthyThreshold:   2,
+		unhealthyThreshold: 3,
+	}
+}
+
+// healthChecker probes every server in the background and feeds the result
+// into the server's alive state.
+type healthChecker struct {
+	config  healthCheckConfig
+	servers []Server
+	client  *http.Client
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// newHealthChecker probes servers through transport, which should be the
+// one used for proxying so probes see the same TLS setup. A nil transport
+// means http.DefaultTransport.
+func newHealthChecker(config healthCheckConfig, servers []Server, transport *http.Transport) *healthChecker {
+	var rt http.RoundTripper = http.DefaultTransport
+	if transport != nil {
+		rt = transport
+	}
+	return &healthChecker{
+		config:  config,
+		servers: servers,
+		client: &http.Client{
+			Transport: rt,
+			Timeout:   config.timeout,
+			// a redirect still means the backend is up, don't follow it
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		stop: make(chan struct{}),
+	}
+}
+
+func (hc *healthChecker) Start() {
+	if hc.config.kind == "none" {
+		return
+	}
+	for _, server := range hc.servers {
+		hc.wg.Add(1)
+		go hc.watch(server)
+	}
+}
+
+func (hc *healthChecker) Stop() {
+	close(hc.stop)
+	hc.wg.Wait()
+}
+
+// watch probes a single server until the checker is stopped. Each server
+// gets its own goroutine so the consecutive counters need no locking.
+func (hc *healthChecker) watch(server Server) {
+	defer hc.wg.Done()
+
+	ticker := time.NewTicker(hc.config.interval)
+	defer ticker.Stop()
+
+	successes, failures := 0, 0
+	for {
+		if hc.probe(server) {
+			successes++
+			failures = 0
+			if !server.IsAlive() && successes >= hc.config.healthyThreshold {
+				fmt.Printf("backend %q is healthy again\n", server.Address())
+				server.SetAlive(true)
+			}
+		} else {
+			failures++
+			successes = 0
+			if server.IsAlive() && failures >= hc.config.unhealthyThreshold {
+				fmt.Printf("backend %q is unhealthy, ejecting\n", server.Address())
+				server.SetAlive(false)
+			}
+		}
+
+		select {
+		case <-hc.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (hc *healthChecker) probe(server Server) bool {
+	if hc.config.kind == "tcp" {
+		conn, err := net.DialTimeout("tcp", dialAddress(server.Address()), hc.config.timeout)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+
+	resp, err := hc.client.Get(strings.TrimRight(server.Address(), "/") + hc.config.path)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
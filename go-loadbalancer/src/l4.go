@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dialTimeout        = 5 * time.Second
+	defaultIdleTimeout = time.Minute
+	maxDatagram        = 64 * 1024
+)
+
+// passthrough balances one client connection of a tcp or udp listener over
+// the listener's pool. A backend that can't be dialed is retried like a
+// failed HTTP request, the client hasn't sent it anything yet.
+func passthrough(port string, pools *poolRegistry, accessLog *accessLogger, client net.Conn) {
+	defer client.Close()
+
+	r := connRequest(client.RemoteAddr())
+	entry := &accessEntry{
+		Time:     time.Now(),
+		Client:   clientIP(r),
+		Listener: port,
+		Proto:    strings.ToUpper(client.LocalAddr().Network()),
+	}
+	defer accessLog.finish(entry)
+
+	match := pools.route(port, r)
+	if match == nil {
+		return
+	}
+	p := match.pool
+	p.retry.budget.recordRequest()
+	entry.Pool = p.name
+
+	var tried []Server
+	for {
+		targetServer, err := p.acquire(nil, r, tried...)
+		if err != nil {
+			entry.Error = err.Error()
+			return
+		}
+		tried = append(tried, targetServer)
+		entry.Upstream, entry.Retries = targetServer.Address(), len(tried)-1
+
+		start := time.Now()
+		entry.Bytes, err = targetServer.ServeConn(client)
+		p.release(targetServer)
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		p.outliers.observe(targetServer, err != nil && !errors.Is(err, errDrained))
+		// a passthrough connection is judged by its dial alone
+		targetServer.Breaker().observe(targetServer.Address(), err != nil && !errors.Is(err, errDrained), 0)
+		if err == nil || errors.Is(err, errDrained) {
+			return
+		}
+
+		// only a failed dial gets here, connections that were made aren't
+		// counted as requests
+		metrics.observe(p.name, targetServer.Address(), 0, time.Since(start))
+		fmt.Printf("backend %q failed: %v\n", targetServer.Address(), err)
+		if !p.retry.allowConn(len(tried) - 1) {
+			return
+		}
+	}
+}
+
+// connRequest stands in for the HTTP request that strategies and sticky
+// sessions look at, so a connection is keyed on its client address.
+func connRequest(remote net.Addr) *http.Request {
+	return &http.Request{RemoteAddr: remote.String(), Header: http.Header{}}
+}
+
+// dialAddress is the host:port of a backend address, with the default port
+// of its scheme when it has none.
+func dialAddress(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return addr
+	}
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// splice copies both ways until each side is done sending and returns the
+// bytes sent to the client. A half-close is passed on where the connection
+// supports it, otherwise the first side to finish ends the exchange.
+func splice(client net.Conn, backend net.Conn) int64 {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		copyConn(backend, client)
+	}()
+	written := copyConn(client, backend)
+	wg.Wait()
+	return written
+}
+
+func copyConn(dst net.Conn, src net.Conn) int64 {
+	// big enough for any datagram, a short buffer would truncate it
+	n, err := io.CopyBuffer(dst, src, make([]byte, maxDatagram))
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok && err == nil {
+		cw.CloseWrite()
+		return n
+	}
+	dst.Close()
+	src.Close()
+	return n
+}
+
+// passthroughListener is the part of the tcp and udp listeners a shutdown
+// deals with: closing the socket and waiting for the connections.
+type passthroughListener struct {
+	mu     sync.Mutex
+	socket io.Closer
+	closed bool
+	conns  sync.WaitGroup
+}
+
+// track keeps socket for Close, it reports false when the listener was
+// already closed and closes socket then.
+func (pl *passthroughListener) track(socket io.Closer) bool {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.closed {
+		socket.Close()
+		return false
+	}
+	pl.socket = socket
+	return true
+}
+
+// Close stops accepting connections, the ones in progress are left to the
+// drain of their backends.
+func (pl *passthroughListener) Close() error {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.closed = true
+	if pl.socket == nil {
+		return nil
+	}
+	return pl.socket.Close()
+}
+
+// Shutdown closes the listener and waits for its connections to finish or
+// for ctx to be done.
+func (pl *passthroughListener) Shutdown(ctx context.Context) error {
+	pl.Close()
+	done := make(chan struct{})
+	go func() {
+		pl.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// tcpProxy passes TCP connections through to the pool of its listener.
+type tcpProxy struct {
+	passthroughListener
+	port      string
+	pools     *poolRegistry
+	accessLog *accessLogger
+}
+
+// ListenAndServe accepts connections until the proxy is closed, it returns
+// nil then.
+func (tp *tcpProxy) ListenAndServe() error {
+	ln, err := net.Listen("tcp", ":"+tp.port)
+	if err != nil {
+		return err
+	}
+	if !tp.track(ln) {
+		return nil
+	}
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			// e.g. out of file descriptors, back off instead of spinning
+			fmt.Printf("tcp accept on %s: %v\n", tp.port, err)
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		tp.conns.Add(1)
+		go func() {
+			defer tp.conns.Done()
+			passthrough(tp.port, tp.pools, tp.accessLog, conn)
+		}()
+	}
+}
+
+// udpProxy passes UDP datagrams through to the pool of its listener. The
+// datagrams of one client address form a session that sticks to a backend
+// until it has been idle for idleTimeout.
+type udpProxy struct {
+	passthroughListener
+	port        string
+	pools       *poolRegistry
+	accessLog   *accessLogger
+	idleTimeout time.Duration
+	sessions    sync.Map // client address -> *udpSession
+}
+
+// ListenAndServe reads datagrams until the proxy is closed, it returns nil
+// then.
+func (up *udpProxy) ListenAndServe() error {
+	conn, err := net.ListenPacket("udp", ":"+up.port)
+	if err != nil {
+		return err
+	}
+	if !up.track(conn) {
+		return nil
+	}
+
+	buf := make([]byte, maxDatagram)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			fmt.Printf("udp read on %s: %v\n", up.port, err)
+			continue
+		}
+
+		// only this goroutine adds sessions, so Load then Store can't race
+		key := addr.String()
+		v, ok := up.sessions.Load(key)
+		if !ok || v.(*udpSession).isClosed() {
+			session := newUDPSession(conn, addr, up.idleTimeout)
+			up.sessions.Store(key, session)
+			up.conns.Add(1)
+			go func() {
+				defer up.conns.Done()
+				defer up.sessions.CompareAndDelete(key, session)
+				passthrough(up.port, up.pools, up.accessLog, session)
+			}()
+			v = session
+		}
+		v.(*udpSession).deliver(slices.Clone(buf[:n]))
+	}
+}
+
+// udpSession is the net.Conn of one client of a udpProxy: reads return the
+// datagrams the client sent, writes go back to the client through the
+// listener's socket. A read after idle time with no traffic either way
+// returns io.EOF, which ends the session.
+type udpSession struct {
+	conn       net.PacketConn
+	addr       net.Addr
+	idle       time.Duration
+	lastActive atomic.Int64 // unix nanoseconds
+	packets    chan []byte
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+func newUDPSession(conn net.PacketConn, addr net.Addr, idle time.Duration) *udpSession {
+	s := &udpSession{
+		conn:    conn,
+		addr:    addr,
+		idle:    idle,
+		packets: make(chan []byte, 64),
+		done:    make(chan struct{}),
+	}
+	s.touch()
+	return s
+}
+
+// deliver queues a datagram from the client. Like a congested network it
+// drops the datagram when the session can't keep up.
+func (s *udpSession) deliver(packet []byte) {
+	select {
+	case s.packets <- packet:
+	default:
+	}
+}
+
+func (s *udpSession) touch() { s.lastActive.Store(time.Now().UnixNano()) }
+
+func (s *udpSession) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *udpSession) Read(b []byte) (int, error) {
+	timer := time.NewTimer(s.idle)
+	defer timer.Stop()
+	for {
+		select {
+		case packet := <-s.packets:
+			s.touch()
+			return copy(b, packet), nil
+		case <-s.done:
+			return 0, net.ErrClosed
+		case <-timer.C:
+			idle := time.Since(time.Unix(0, s.lastActive.Load()))
+			if idle >= s.idle {
+				return 0, io.EOF
+			}
+			timer.Reset(s.idle - idle)
+		}
+	}
+}
+
+func (s *udpSession) Write(b []byte) (int, error) {
+	if s.isClosed() {
+		return 0, net.ErrClosed
+	}
+	s.touch()
+	return s.conn.WriteTo(b, s.addr)
+}
+
+// Close ends the session, the listener's socket stays open for the others.
+func (s *udpSession) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	return nil
+}
+
+func (s *udpSession) LocalAddr() net.Addr  { return s.conn.LocalAddr() }
+func (s *udpSession) RemoteAddr() net.Addr { return s.addr }
+
+// Deadlines aren't used by splice, the idle timeout takes their place.
+func (s *udpSession) SetDeadline(t time.Time) error      { return nil }
+func (s *udpSession) SetReadDeadline(t time.Time) error  { return nil }
+func (s *udpSession) SetWriteDeadline(t time.Time) error { return nil }
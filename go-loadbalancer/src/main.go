@@ -1,45 +1,125 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 type Server interface {
 	Address() string
 	IsAlive() bool
-	Serve(rw http.ResponseWriter, r *http.Request)
+	SetAlive(alive bool)
+	Available() bool
+	Up() bool
+	AdminState() adminState
+	SetAdminState(state adminState)
+	Drain(timeout time.Duration)
+	Eject(d time.Duration)
+	Ejected() bool
+	Breaker() *circuitBreaker
+	SetBreaker(cb *circuitBreaker)
+	Weight() int
+	InFlight() int64
+	MaxConnections() int
+	Full() bool
+	Acquire() bool
+	Release()
+	Serve(rw http.ResponseWriter, r *http.Request) error
+	ServeConn(client net.Conn) (written int64, err error)
 }
 
 type simpleServer struct {
-	addrs string
-	proxy *httputil.ReverseProxy
+	addrs        string
+	dialAddr     string // host:port for passthrough connections
+	weight       int
+	proxy        *httputil.ReverseProxy
+	alive        atomic.Bool
+	ejectedUntil atomic.Int64 // unix nanoseconds
+	adminState   atomic.Int32
+	inFlight     atomic.Int64
+	maxConns     int64 // 0 means no limit
+
+	drainMu    sync.Mutex // guards drainTimer, only taken on state changes
+	drainTimer *time.Timer
+	cutoff     atomic.Pointer[cutoff]
+
+	breaker atomic.Pointer[circuitBreaker] // nil when the pool has none
 }
 
-func newSimpleServer(addr string) *simpleServer {
+// proxyErrKey carries a pointer to the error of a proxied request through the
+// request context, so Serve can hand it back instead of writing a 502.
+type proxyErrKey struct{}
+
+// newSimpleServer proxies to addr through transport, nil means
+// http.DefaultTransport. maxConns caps the concurrent requests, 0 means no
+// limit.
+func newSimpleServer(addr string, weight int, maxConns int, transport *http.Transport) *simpleServer {
 	serverUrl, err := url.Parse(addr)
 	handleErr(err)
 
-	return &simpleServer{
-		addrs: addr,
-		proxy: httputil.NewSingleHostReverseProxy(serverUrl),
+	if weight < 1 {
+		weight = 1
+	}
+	server := &simpleServer{
+		addrs:    addr,
+		dialAddr: dialAddress(addr),
+		weight:   weight,
+		proxy:    httputil.NewSingleHostReverseProxy(serverUrl),
+		maxConns: int64(max(maxConns, 0)),
+	}
+	if transport != nil {
+		server.proxy.Transport = transport
 	}
+	// the load balancer sets the request ID on the response before proxying,
+	// a backend echoing it back would add a second one
+	server.proxy.ModifyResponse = func(resp *http.Response) error {
+		resp.Header.Del(requestIDHeader)
+		if h, ok := resp.Request.Context().Value(backendHeaderKey{}).(*http.Header); ok {
+			*h = resp.Header.Clone()
+		}
+		return nil
+	}
+	server.proxy.ErrorHandler = func(rw http.ResponseWriter, r *http.Request, err error) {
+		if p, ok := r.Context().Value(proxyErrKey{}).(*error); ok {
+			*p = err
+		}
+	}
+	// backends are assumed healthy until the health checker says otherwise
+	server.alive.Store(true)
+	server.cutoff.Store(newCutoff())
+	return server
 }
 
+// loadBalancer is one listener. Its routes and pools are looked up on every
+// request so reloads take effect without restarting listeners.
 type loadBalancer struct {
-	port            string
-	roundRobinCount int
-	servers         []Server
+	port      string
+	pools     *poolRegistry
+	accessLog *accessLogger
+	cache     *responseCache
 }
 
-func newLoadBalancer(port string, servers []Server) *loadBalancer {
+func newLoadBalancer(port string, pools *poolRegistry, accessLog *accessLogger, cache *responseCache) *loadBalancer {
 	return &loadBalancer{
-		port:            port,
-		roundRobinCount: 0,
-		servers:         servers,
+		port:      port,
+		pools:     pools,
+		accessLog: accessLog,
+		cache:     cache,
 	}
 }
 
@@ -52,41 +132,345 @@ func handleErr(err error) {
 
 func (s *simpleServer) Address() string { return s.addrs }
 
-func (s *simpleServer) IsAlive() bool { return true }
+func (s *simpleServer) IsAlive() bool { return s.alive.Load() }
+
+func (s *simpleServer) SetAlive(alive bool) { s.alive.Store(alive) }
 
-func (s *simpleServer) Serve(rw http.ResponseWriter, r *http.Request) {
-	s.proxy.ServeHTTP(rw, r)
+// Available reports whether the server may take new requests: it is enabled
+// through the admin API, passes its health checks, isn't ejected by outlier
+// detection, has a free connection slot and its circuit breaker lets
+// requests through. It is for picking a server, an open breaker whose
+// cool-down is over turns half-open.
+func (s *simpleServer) Available() bool {
+	return s.AdminState() == stateEnabled && s.IsAlive() && !s.Ejected() && !s.Full() && s.Breaker().allow()
 }
 
-func (lb *loadBalancer) getNextAvailableServer() Server {
-	server := lb.servers[lb.roundRobinCount%len(lb.servers)]
-	for !server.IsAlive() {
-		lb.roundRobinCount++
-		server = lb.servers[lb.roundRobinCount%len(lb.servers)]
+// Up reports what Available would without changing the circuit breaker, for
+// reporting.
+func (s *simpleServer) Up() bool {
+	return s.AdminState() == stateEnabled && s.IsAlive() && !s.Ejected() && !s.Full() && s.Breaker().wouldAllow()
+}
+
+func (s *simpleServer) AdminState() adminState { return adminState(s.adminState.Load()) }
+
+// SetAdminState changes the admin state. Leaving the draining state calls off
+// a pending drain deadline.
+func (s *simpleServer) SetAdminState(state adminState) {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+
+	if state != stateDraining && s.drainTimer != nil {
+		s.drainTimer.Stop()
+		s.drainTimer = nil
+		s.cutoff.Store(newCutoff())
 	}
-	lb.roundRobinCount++
-	return server
+	s.adminState.Store(int32(state))
+}
+
+// Drain stops new assignments to the server and lets the requests and
+// upgraded connections it is serving run for up to timeout, anything still
+// running then is cut off. A timeout of 0 cuts them off right away.
+func (s *simpleServer) Drain(timeout time.Duration) {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+
+	s.adminState.Store(int32(stateDraining))
+	if s.drainTimer != nil {
+		s.drainTimer.Stop()
+	}
+	s.drainTimer = time.AfterFunc(timeout, s.cutoff.Load().cancel)
+}
+
+func (s *simpleServer) Eject(d time.Duration) { s.ejectedUntil.Store(time.Now().Add(d).UnixNano()) }
+
+func (s *simpleServer) Ejected() bool { return time.Now().UnixNano() < s.ejectedUntil.Load() }
+
+func (s *simpleServer) Breaker() *circuitBreaker { return s.breaker.Load() }
+
+func (s *simpleServer) SetBreaker(cb *circuitBreaker) { s.breaker.Store(cb) }
+
+func (s *simpleServer) Weight() int { return s.weight }
+
+func (s *simpleServer) InFlight() int64 { return s.inFlight.Load() }
+
+func (s *simpleServer) MaxConnections() int { return int(s.maxConns) }
+
+func (s *simpleServer) Full() bool { return s.maxConns > 0 && s.InFlight() >= s.maxConns }
+
+// Acquire reserves a connection slot, it fails when the server is at its
+// connection limit or its half-open circuit breaker has no trial left. Every
+// successful Acquire must be paired with Release.
+func (s *simpleServer) Acquire() bool {
+	for {
+		n := s.inFlight.Load()
+		if s.maxConns > 0 && n >= s.maxConns {
+			return false
+		}
+		if s.inFlight.CompareAndSwap(n, n+1) {
+			break
+		}
+	}
+	if !s.Breaker().acquire() {
+		s.inFlight.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (s *simpleServer) Release() { s.inFlight.Add(-1) }
+
+// Serve proxies the request to the backend, the caller holds a connection
+// slot from Acquire. When the backend can't be reached nothing is written to
+// rw and the error is returned, so the caller can retry elsewhere or answer
+// on its own. A request cut off by a drain deadline returns errDrained.
+func (s *simpleServer) Serve(rw http.ResponseWriter, r *http.Request) error {
+	c := s.cutoff.Load()
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	// cancelling the outgoing request also closes an upgraded connection
+	stop := context.AfterFunc(c.ctx, cancel)
+	defer stop()
+
+	var proxyErr error
+	ctx = context.WithValue(ctx, proxyErrKey{}, &proxyErr)
+	s.proxy.ServeHTTP(rw, r.WithContext(ctx))
+	if c.ctx.Err() != nil {
+		return errDrained
+	}
+	return proxyErr
 }
 
-func (lb *loadBalancer) serverProxy(rw http.ResponseWriter, r *http.Request) {
-	targetServer := lb.getNextAvailableServer()
-	fmt.Printf("forwarding request to address: %q\n", targetServer.Address())
-	targetServer.Serve(rw, r)
+// ServeConn connects client to the backend over the client's network and
+// copies bytes both ways until both sides are done, the caller holds a
+// connection slot from Acquire. written counts the bytes sent to the client.
+// Only a failed dial is returned as an error, nothing has been sent then and
+// the connection can go elsewhere.
+func (s *simpleServer) ServeConn(client net.Conn) (written int64, err error) {
+	c := s.cutoff.Load()
+	backend, err := net.DialTimeout(client.LocalAddr().Network(), s.dialAddr, dialTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer backend.Close()
+
+	stop := context.AfterFunc(c.ctx, func() {
+		client.Close()
+		backend.Close()
+	})
+	defer stop()
+
+	written = splice(client, backend)
+	if c.ctx.Err() != nil {
+		return written, errDrained
+	}
+	return written, nil
+}
+
+// serverProxy sends r to the matching pool, through the response cache when
+// the route has it on, and notes where it went in entry.
+func (lb *loadBalancer) serverProxy(rw http.ResponseWriter, r *http.Request, entry *accessEntry) {
+	match := lb.pools.route(lb.port, r)
+	if match == nil {
+		http.Error(rw, "no route for request", http.StatusNotFound)
+		return
+	}
+	entry.Pool, entry.Route = match.pool.name, match.route
+	if match.limiter != nil {
+		if ok, wait := match.limiter.allow(r, match.route); !ok {
+			rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(rw, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	forward := func(rw http.ResponseWriter, r *http.Request) {
+		lb.forward(rw, r, match.pool, entry)
+	}
+	if match.cache {
+		lb.cache.serve(rw, r, entry, forward)
+		return
+	}
+	forward(rw, r)
+}
+
+// forward sends r to a backend of p, retrying on another one when allowed.
+func (lb *loadBalancer) forward(rw http.ResponseWriter, r *http.Request, p *pool, entry *accessEntry) {
+	p.retry.budget.recordRequest()
+
+	var tried []Server
+	for {
+		targetServer, err := p.acquire(rw, r, tried...)
+		if err != nil {
+			entry.Error = err.Error()
+			switch {
+			case r.Context().Err() != nil:
+				// the client gave up while queued
+			case errors.Is(err, errNoBackend) && len(tried) > 0:
+				http.Error(rw, "bad gateway", http.StatusBadGateway)
+			default:
+				http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+			}
+			return
+		}
+		tried = append(tried, targetServer)
+		entry.Upstream, entry.Retries = targetServer.Address(), len(tried)-1
+
+		rec := newStatusRecorder(rw)
+		start := time.Now()
+		err = targetServer.Serve(rec, r)
+		p.release(targetServer)
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		if err != nil && r.Context().Err() != nil {
+			// the client went away, that says nothing about the backend
+			return
+		}
+		if errors.Is(err, errDrained) {
+			if rec.status == 0 {
+				http.Error(rw, "backend is shutting down", http.StatusServiceUnavailable)
+			}
+			return
+		}
+		metrics.observe(p.name, targetServer.Address(), rec.status, time.Since(start))
+		p.outliers.observe(targetServer, err != nil || rec.status >= 500)
+		targetServer.Breaker().observe(targetServer.Address(), err != nil || rec.status >= 500, rec.latency(start))
+		if err == nil {
+			return
+		}
+
+		fmt.Printf("backend %q failed: %v\n", targetServer.Address(), err)
+		if !p.retry.allow(r, len(tried)-1) {
+			http.Error(rw, "bad gateway", http.StatusBadGateway)
+			return
+		}
+	}
+}
+
+func (lb *loadBalancer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set(requestIDHeader, ensureRequestID(r))
+	setForwardedHeaders(r)
+
+	entry := lb.accessLog.start(r, lb.port)
+	rec := newStatusRecorder(rw)
+	lb.serverProxy(rec, r, entry)
+	entry.Status, entry.Bytes = rec.status, rec.bytes
+	lb.accessLog.finish(entry)
 }
 
 func main() {
-	servers := []Server{
-		newSimpleServer("https://www.facebook.com"),
-		newSimpleServer("https://github.com/dev-kumaralingam"),
-		newSimpleServer("https://github.com/dev-dhanushkumar"),
+	configPath := flag.String("config", "", "path to a JSON config file, the built-in backends are used when empty")
+	watch := flag.Duration("watch", 0, "poll the config file for changes at this interval, 0 disables watching")
+	flag.Parse()
+
+	cfg := defaultConfig()
+	if *configPath != "" {
+		var err error
+		cfg, err = loadConfig(*configPath)
+		handleErr(err)
 	}
 
-	lb := newLoadBalancer("8080", servers)
-	handleRedirect := func(rw http.ResponseWriter, req *http.Request) {
-		lb.serverProxy(rw, req)
+	pools := &poolRegistry{}
+	handleErr(pools.apply(cfg))
+	accessLog, err := newAccessLogger(cfg.AccessLog)
+	handleErr(err)
+	cache := newResponseCache(cfg.Cache)
+
+	// every listener is kept so a shutdown can stop them all
+	var servers []listener
+	serve := func(srv listener, listen func() error) {
+		servers = append(servers, srv)
+		go func() {
+			if err := listen(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				handleErr(err)
+			}
+		}()
 	}
-	http.HandleFunc("/", handleRedirect)
 
-	fmt.Printf("serving request at localhost:%s\n", lb.port)
-	http.ListenAndServe(":"+lb.port, nil)
+	for _, l := range cfg.Listeners {
+		switch l.Mode {
+		case "tcp":
+			fmt.Printf("passing tcp through at localhost:%s\n", l.Port)
+			tp := &tcpProxy{port: l.Port, pools: pools, accessLog: accessLog}
+			serve(tp, tp.ListenAndServe)
+			continue
+		case "udp":
+			fmt.Printf("passing udp through at localhost:%s\n", l.Port)
+			up := &udpProxy{port: l.Port, pools: pools, accessLog: accessLog, idleTimeout: defaultIdleTimeout}
+			if l.IdleTimeout > 0 {
+				up.idleTimeout = time.Duration(l.IdleTimeout)
+			}
+			serve(up, up.ListenAndServe)
+			continue
+		}
+
+		lb := newLoadBalancer(l.Port, pools, accessLog, cache)
+		if l.TLS == nil {
+			fmt.Printf("serving request at localhost:%s\n", lb.port)
+			srv := &http.Server{Addr: ":" + lb.port, Handler: lb}
+			serve(srv, srv.ListenAndServe)
+			continue
+		}
+
+		tlsConfig, err := l.TLS.config()
+		handleErr(err)
+		fmt.Printf("serving request at https://localhost:%s\n", lb.port)
+		srv := &http.Server{Addr: ":" + lb.port, Handler: lb, TLSConfig: tlsConfig}
+		serve(srv, func() error { return srv.ListenAndServeTLS("", "") })
+		if redirect := l.TLS.RedirectHTTPPort; redirect != "" {
+			fmt.Printf("redirecting http://localhost:%s to https\n", redirect)
+			redirectSrv := &http.Server{Addr: ":" + redirect, Handler: redirectToHTTPS(lb.port)}
+			serve(redirectSrv, redirectSrv.ListenAndServe)
+		}
+	}
+
+	if cfg.Admin.Address != "" {
+		admin := &adminServer{pools: pools, cache: cache}
+		fmt.Printf("admin API at %s\n", cfg.Admin.Address)
+		adminSrv := &http.Server{Addr: cfg.Admin.Address, Handler: admin.handler()}
+		serve(adminSrv, adminSrv.ListenAndServe)
+	}
+
+	reload := func() {
+		next, err := loadConfig(*configPath)
+		if err != nil {
+			fmt.Printf("reload failed, keeping current config: %v\n", err)
+			return
+		}
+		if !slices.Equal(next.ports(), cfg.ports()) {
+			fmt.Println("listener ports changed, new ports are ignored until restart")
+		}
+		if err := pools.apply(next); err != nil {
+			fmt.Printf("reload failed, keeping current config: %v\n", err)
+			return
+		}
+		fmt.Println("config reloaded")
+	}
+
+	if *configPath != "" && *watch > 0 {
+		go watchConfig(*configPath, *watch, reload)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	for {
+		select {
+		case <-hup:
+			if *configPath == "" {
+				fmt.Println("no config file to reload")
+				continue
+			}
+			reload()
+		case sig := <-stop:
+			timeout := pools.drainTimeout()
+			fmt.Printf("received %s, shutting down within %s\n", sig, timeout)
+			// a second signal skips the wait
+			signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+			shutdown(servers, pools, timeout)
+			fmt.Println("shutdown complete")
+			return
+		}
+	}
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// backendMetrics are the counters kept for one backend of one pool. They
+// live outside the pool so they keep counting across reloads.
+type backendMetrics struct {
+	pool    string
+	backend string
+
+	requests  [6]atomic.Int64 // by status class, index 0 counts connection errors
+	errors    atomic.Int64    // connection errors and 5xx responses
+	buckets   []atomic.Int64  // cumulative counts are computed when writing
+	latencyUs atomic.Int64
+	count     atomic.Int64
+}
+
+type metricsKey struct {
+	pool    string
+	backend string
+}
+
+// metricsRegistry is written on every request, a sync.Map keeps that path
+// free of locks once a backend has been seen.
+type metricsRegistry struct {
+	backends sync.Map // metricsKey -> *backendMetrics
+}
+
+var metrics = &metricsRegistry{}
+
+func (mr *metricsRegistry) backend(pool string, backend string) *backendMetrics {
+	key := metricsKey{pool: pool, backend: backend}
+	if m, ok := mr.backends.Load(key); ok {
+		return m.(*backendMetrics)
+	}
+	m, _ := mr.backends.LoadOrStore(key, &backendMetrics{
+		pool:    pool,
+		backend: backend,
+		buckets: make([]atomic.Int64, len(latencyBuckets)),
+	})
+	return m.(*backendMetrics)
+}
+
+// observe records one attempt against a backend. status is 0 when the
+// backend couldn't be reached.
+func (mr *metricsRegistry) observe(pool string, backend string, status int, elapsed time.Duration) {
+	m := mr.backend(pool, backend)
+
+	class := status / 100
+	if class < 1 || class > 5 {
+		class = 0
+	}
+	m.requests[class].Add(1)
+	if class == 0 || class == 5 {
+		m.errors.Add(1)
+	}
+
+	seconds := elapsed.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			m.buckets[i].Add(1)
+			break
+		}
+	}
+	m.latencyUs.Add(elapsed.Microseconds())
+	m.count.Add(1)
+}
+
+// write prints every metric in the Prometheus text exposition format.
+// Backend gauges are read from the pools currently in use.
+func (mr *metricsRegistry) write(w io.Writer, pools []*pool) {
+	var all []*backendMetrics
+	mr.backends.Range(func(_, v any) bool {
+		all = append(all, v.(*backendMetrics))
+		return true
+	})
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].pool != all[j].pool {
+			return all[i].pool < all[j].pool
+		}
+		return all[i].backend < all[j].backend
+	})
+
+	classes := []string{"error", "1xx", "2xx", "3xx", "4xx", "5xx"}
+	fmt.Fprintln(w, "# HELP lb_backend_requests_total Requests sent to a backend by status class, retries included.")
+	fmt.Fprintln(w, "# TYPE lb_backend_requests_total counter")
+	for _, m := range all {
+		for class, name := range classes {
+			fmt.Fprintf(w, "lb_backend_requests_total{%s,code=\"%s\"} %d\n", m.labels(), name, m.requests[class].Load())
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP lb_backend_errors_total Connection errors and 5xx responses from a backend.")
+	fmt.Fprintln(w, "# TYPE lb_backend_errors_total counter")
+	for _, m := range all {
+		fmt.Fprintf(w, "lb_backend_errors_total{%s} %d\n", m.labels(), m.errors.Load())
+	}
+
+	fmt.Fprintln(w, "# HELP lb_backend_request_duration_seconds Latency of requests sent to a backend.")
+	fmt.Fprintln(w, "# TYPE lb_backend_request_duration_seconds histogram")
+	for _, m := range all {
+		var cumulative int64
+		for i, bound := range latencyBuckets {
+			cumulative += m.buckets[i].Load()
+			fmt.Fprintf(w, "lb_backend_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", m.labels(), strconv.FormatFloat(bound, 'f', -1, 64), cumulative)
+		}
+		count := m.count.Load()
+		fmt.Fprintf(w, "lb_backend_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", m.labels(), count)
+		fmt.Fprintf(w, "lb_backend_request_duration_seconds_sum{%s} %g\n", m.labels(), float64(m.latencyUs.Load())/1e6)
+		fmt.Fprintf(w, "lb_backend_request_duration_seconds_count{%s} %d\n", m.labels(), count)
+	}
+
+	fmt.Fprintln(w, "# HELP lb_backend_up Whether a backend can take new requests.")
+	fmt.Fprintln(w, "# TYPE lb_backend_up gauge")
+	for _, p := range pools {
+		for _, server := range p.servers {
+			fmt.Fprintf(w, "lb_backend_up{%s} %d\n", backendLabels(p.name, server.Address()), boolToInt(server.Up()))
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP lb_backend_in_flight Requests a backend is currently handling.")
+	fmt.Fprintln(w, "# TYPE lb_backend_in_flight gauge")
+	for _, p := range pools {
+		for _, server := range p.servers {
+			fmt.Fprintf(w, "lb_backend_in_flight{%s} %d\n", backendLabels(p.name, server.Address()), server.InFlight())
+		}
+	}
+}
+
+func (m *backendMetrics) labels() string {
+	return backendLabels(m.pool, m.backend)
+}
+
+// labelEscaper escapes label values the way the text format expects, which
+// differs from Go's %q for anything outside printable ASCII.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func backendLabels(pool string, backend string) string {
+	return fmt.Sprintf(`pool="%s",backend="%s"`, labelEscaper.Replace(pool), labelEscaper.Replace(backend))
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
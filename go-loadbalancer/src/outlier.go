@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// outlierDetector ejects servers that keep failing on live traffic, it works
+// independently of the active health checks. Ejected servers come back on
+// their own once the ejection duration has passed.
+type outlierDetector struct {
+	consecutiveErrors  int // 0 disables detection
+	ejectionDuration   time.Duration
+	maxEjectionPercent int
+	servers            []Server
+	failures           map[Server]*atomic.Int64
+}
+
+func newOutlierDetector(settings outlierSettings, servers []Server) *outlierDetector {
+	od := &outlierDetector{
+		consecutiveErrors:  5,
+		ejectionDuration:   30 * time.Second,
+		maxEjectionPercent: 50,
+		servers:            servers,
+		failures:           make(map[Server]*atomic.Int64, len(servers)),
+	}
+	if settings.ConsecutiveErrors != nil {
+		od.consecutiveErrors = *settings.ConsecutiveErrors
+	}
+	if settings.EjectionDuration > 0 {
+		od.ejectionDuration = time.Duration(settings.EjectionDuration)
+	}
+	if settings.MaxEjectionPercent > 0 {
+		od.maxEjectionPercent = settings.MaxEjectionPercent
+	}
+	for _, server := range servers {
+		od.failures[server] = &atomic.Int64{}
+	}
+	return od
+}
+
+// observe records the outcome of a proxied request. A failure is a
+// connection error or a 5xx response.
+func (od *outlierDetector) observe(server Server, failed bool) {
+	if od.consecutiveErrors <= 0 {
+		return
+	}
+	failures, ok := od.failures[server]
+	if !ok {
+		return
+	}
+	if !failed {
+		failures.Store(0)
+		return
+	}
+	if failures.Add(1) < int64(od.consecutiveErrors) || server.Ejected() {
+		return
+	}
+	if !od.canEject() {
+		fmt.Printf("backend %q keeps failing but too many backends are ejected already\n", server.Address())
+		return
+	}
+
+	failures.Store(0)
+	server.Eject(od.ejectionDuration)
+	fmt.Printf("backend %q failed %d times in a row, ejecting for %s\n", server.Address(), od.consecutiveErrors, od.ejectionDuration)
+}
+
+func (od *outlierDetector) canEject() bool {
+	ejected := 0
+	for _, server := range od.servers {
+		if server.Ejected() {
+			ejected++
+		}
+	}
+	return (ejected+1)*100 <= od.maxEjectionPercent*len(od.servers)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pool is a named set of backends balanced with a single strategy and
+// watched by its own health checker.
+type pool struct {
+	name     string
+	strategy Strategy
+	servers  []Server
+	checker  *healthChecker
+	retry    *retryPolicy
+	outliers *outlierDetector
+	sticky   *stickySessions
+	tls      *backendTLS
+	tlsFiles backendTLSFiles
+	queue    *connQueue
+}
+
+// pick returns the server for r: the one the client is pinned to when sticky
+// sessions are on and it can still take requests, even if it is at its
+// connection limit, otherwise the next available server, which the client is
+// then pinned to. pinned reports the first case.
+func (p *pool) pick(rw http.ResponseWriter, r *http.Request, exclude ...Server) (server Server, pinned bool) {
+	if p.sticky != nil {
+		if server := p.sticky.pinned(r, exclude); server != nil {
+			return server, true
+		}
+	}
+	server = p.getNextAvailableServer(r, exclude...)
+	if server != nil && p.sticky != nil {
+		p.sticky.pin(rw, r, server)
+	}
+	return server, false
+}
+
+// getNextAvailableServer asks the pool's balancing strategy for an available
+// server other than the excluded ones, it returns nil when none is left.
+func (p *pool) getNextAvailableServer(r *http.Request, exclude ...Server) Server {
+	servers := p.servers
+	if len(exclude) > 0 {
+		servers = slices.DeleteFunc(slices.Clone(servers), func(s Server) bool {
+			return slices.Contains(exclude, s)
+		})
+	}
+	return p.strategy.Next(servers, r)
+}
+
+// generation is everything a reload replaces at once: the pools and the
+// routing rules of each listener.
+type generation struct {
+	pools        map[string]*pool
+	routers      map[string]*router // by listener port
+	drainTimeout time.Duration
+}
+
+// poolRegistry holds the current generation. A reload builds a complete new
+// generation and swaps the pointer at once; requests load it without locking
+// and keep using the servers they picked until they finish.
+type poolRegistry struct {
+	reloadMu sync.Mutex // serializes apply, SIGHUP and the file watcher may race
+	current  atomic.Pointer[generation]
+}
+
+func (pr *poolRegistry) get(name string) *pool {
+	gen := pr.current.Load()
+	if gen == nil {
+		return nil
+	}
+	return gen.pools[name]
+}
+
+// all returns the current pools sorted by name.
+func (pr *poolRegistry) all() []*pool {
+	gen := pr.current.Load()
+	if gen == nil {
+		return nil
+	}
+	pools := make([]*pool, 0, len(gen.pools))
+	for _, p := range gen.pools {
+		pools = append(pools, p)
+	}
+	slices.SortFunc(pools, func(a, b *pool) int { return strings.Compare(a.name, b.name) })
+	return pools
+}
+
+// drainTimeout is the drain deadline of the current config.
+func (pr *poolRegistry) drainTimeout() time.Duration {
+	gen := pr.current.Load()
+	if gen == nil {
+		return defaultDrainTimeout
+	}
+	return gen.drainTimeout
+}
+
+// route returns where a request on the given listener port should go, or nil
+// when no route matches.
+func (pr *poolRegistry) route(port string, r *http.Request) *routeMatch {
+	gen := pr.current.Load()
+	if gen == nil {
+		return nil
+	}
+	rt, ok := gen.routers[port]
+	if !ok {
+		return nil
+	}
+	name, route, cache := rt.poolFor(r)
+	p, ok := gen.pools[name]
+	if !ok {
+		return nil
+	}
+	return &routeMatch{pool: p, route: route, cache: cache, limiter: rt.limiter}
+}
+
+// apply builds the pools and routes described by cfg, swaps them in and
+// retires the previous generation, draining the backends it drops. cfg must
+// already be validated; on error the current generation stays in place.
+func (pr *poolRegistry) apply(cfg *config) error {
+	pr.reloadMu.Lock()
+	defer pr.reloadMu.Unlock()
+
+	var old map[string]*pool
+	if prev := pr.current.Load(); prev != nil {
+		old = prev.pools
+	}
+
+	pools, err := buildPools(cfg, old)
+	if err != nil {
+		return err
+	}
+	next := &generation{
+		pools:        pools,
+		routers:      make(map[string]*router, len(cfg.Listeners)),
+		drainTimeout: cfg.drainTimeout(),
+	}
+	for _, l := range cfg.Listeners {
+		next.routers[l.Port] = newRouter(l)
+	}
+	for _, p := range next.pools {
+		p.checker.Start()
+	}
+	pr.current.Store(next)
+
+	for _, p := range old {
+		p.checker.Stop()
+	}
+	retire(old, next.pools, next.drainTimeout)
+	return nil
+}
+
+// buildPools creates the pools for cfg. Backends that exist in the previous
+// generation with the same address, weight, connection limit and TLS settings
+// and files are carried over, so their health state and in-flight counters
+// survive the reload. Rotated certificates get new backends with a new
+// transport.
+func buildPools(cfg *config, old map[string]*pool) (map[string]*pool, error) {
+	pools := make(map[string]*pool, len(cfg.Pools))
+	for _, pc := range cfg.Pools {
+		transport, tlsFiles, err := pc.TLS.transport()
+		if err != nil {
+			return nil, fmt.Errorf("pool %q: %w", pc.Name, err)
+		}
+
+		existing := make(map[string]Server)
+		var prevSticky *stickySessions
+		if prev, ok := old[pc.Name]; ok {
+			if reflect.DeepEqual(prev.tls, pc.TLS) && reflect.DeepEqual(prev.tlsFiles, tlsFiles) {
+				for _, server := range prev.servers {
+					existing[server.Address()] = server
+				}
+			}
+			prevSticky = prev.sticky
+		}
+
+		servers := make([]Server, 0, len(pc.Backends))
+		for _, b := range pc.Backends {
+			server, ok := existing[b.Address]
+			if !ok || server.Weight() != max(b.Weight, 1) || server.MaxConnections() != max(b.MaxConnections, 0) {
+				server = newSimpleServer(b.Address, b.Weight, b.MaxConnections, transport)
+			}
+			// a carried over breaker keeps its state unless its settings changed
+			if !server.Breaker().configuredWith(pc.CircuitBreaker) {
+				server.SetBreaker(newCircuitBreaker(pc.CircuitBreaker))
+			}
+			servers = append(servers, server)
+		}
+
+		// the config was validated, so the strategy is known
+		strategy, _ := newStrategy(pc.Strategy, pc.HashOn)
+		pools[pc.Name] = &pool{
+			name:     pc.Name,
+			strategy: strategy,
+			servers:  servers,
+			checker:  newHealthChecker(pc.HealthCheck.healthCheck(pc.network()), servers, transport),
+			retry:    pc.Retry.policy(),
+			outliers: newOutlierDetector(pc.OutlierDetection, servers),
+			sticky:   newStickySessions(pc.Sticky, servers, prevSticky),
+			tls:      pc.TLS,
+			tlsFiles: tlsFiles,
+			queue:    newConnQueue(pc.Queue),
+		}
+	}
+	return pools, nil
+}
+
+// watchConfig polls the config file and calls reload whenever its
+// modification time changes.
+func watchConfig(path string, interval time.Duration, reload func()) {
+	var lastMod time.Time
+	if info, err := os.Stat(path); err == nil {
+		lastMod = info.ModTime()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		info, err := os.Stat(path)
+		if err != nil {
+			fmt.Printf("watch config: %v\n", err)
+			continue
+		}
+		if info.ModTime().Equal(lastMod) {
+			continue
+		}
+		lastMod = info.ModTime()
+		reload()
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testConfig is a listener on port 8080 sending everything to pool "web",
+// whose backends listen on nothing and aren't health checked.
+func testConfig(backends ...backendConfig) *config {
+	return &config{
+		Listeners: []listenerConfig{{Port: "8080", Pool: "web"}},
+		Pools: []poolConfig{{
+			Name:        "web",
+			Strategy:    "least_connections",
+			Backends:    backends,
+			HealthCheck: healthCheckSettings{Type: "none"},
+			Queue:       queueSettings{Size: 100, Timeout: duration(time.Second)},
+		}},
+		DrainTimeout: duration(time.Minute),
+	}
+}
+
+func applyConfig(t *testing.T, pr *poolRegistry, cfg *config) {
+	t.Helper()
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pr.apply(cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func serverAt(p *pool, address string) Server {
+	for _, server := range p.servers {
+		if server.Address() == address {
+			return server
+		}
+	}
+	return nil
+}
+
+func TestReloadCarriesServersOver(t *testing.T) {
+	pr := &poolRegistry{}
+	applyConfig(t, pr, testConfig(
+		backendConfig{Address: "http://127.0.0.1:10001"},
+		backendConfig{Address: "http://127.0.0.1:10002"},
+		backendConfig{Address: "http://127.0.0.1:10003"},
+	))
+	old := pr.get("web")
+	kept := serverAt(old, "http://127.0.0.1:10002")
+	dropped := serverAt(old, "http://127.0.0.1:10001")
+	reweighted := serverAt(old, "http://127.0.0.1:10003")
+	kept.Acquire()
+	kept.SetAlive(false)
+
+	applyConfig(t, pr, testConfig(
+		backendConfig{Address: "http://127.0.0.1:10002"},
+		backendConfig{Address: "http://127.0.0.1:10003", Weight: 5},
+		backendConfig{Address: "http://127.0.0.1:10004"},
+	))
+	p := pr.get("web")
+	if serverAt(p, "http://127.0.0.1:10002") != kept {
+		t.Fatal("an unchanged backend was replaced")
+	}
+	if kept.InFlight() != 1 || kept.IsAlive() {
+		t.Fatal("the carried over backend lost its in-flight count or health")
+	}
+	if serverAt(p, "http://127.0.0.1:10003") == reweighted {
+		t.Fatal("a backend with a new weight was carried over")
+	}
+	if dropped.AdminState() != stateDraining {
+		t.Fatalf("a dropped backend is %v, want draining", dropped.AdminState())
+	}
+	kept.Release()
+}
+
+func TestQueueHoldsConnectionLimit(t *testing.T) {
+	pr := &poolRegistry{}
+	applyConfig(t, pr, testConfig(
+		backendConfig{Address: "http://127.0.0.1:10001", MaxConnections: 1},
+		backendConfig{Address: "http://127.0.0.1:10002", MaxConnections: 2},
+	))
+	p := pr.get("web")
+
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				r := testRequest(g)
+				server, err := p.acquire(httptest.NewRecorder(), r)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if server.InFlight() > int64(server.MaxConnections()) {
+					t.Errorf("%s has %d requests in flight over its limit", server.Address(), server.InFlight())
+				}
+				time.Sleep(100 * time.Microsecond)
+				p.release(server)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, server := range p.servers {
+		if n := server.InFlight(); n != 0 {
+			t.Errorf("%s has %d requests in flight, want 0", server.Address(), n)
+		}
+	}
+	if n := p.queue.waiting.Load(); n != 0 {
+		t.Errorf("%d requests still counted as waiting", n)
+	}
+}
+
+func TestQueueFullAnswersAtCapacity(t *testing.T) {
+	pr := &poolRegistry{}
+	cfg := testConfig(backendConfig{Address: "http://127.0.0.1:10001", MaxConnections: 1})
+	cfg.Pools[0].Queue = queueSettings{Size: 0}
+	applyConfig(t, pr, cfg)
+	p := pr.get("web")
+
+	server, err := p.acquire(httptest.NewRecorder(), testRequest(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.acquire(httptest.NewRecorder(), testRequest(1)); !errors.Is(err, errBackendsFull) {
+		t.Fatalf("acquire on a full pool without a queue: %v, want %v", err, errBackendsFull)
+	}
+	p.release(server)
+
+	server.SetAlive(false)
+	if _, err := p.acquire(httptest.NewRecorder(), testRequest(1)); !errors.Is(err, errNoBackend) {
+		t.Fatalf("acquire with no healthy backend: %v, want %v", err, errNoBackend)
+	}
+}
+
+// TestReloadUnderLoad sends requests through route, acquire and release
+// while the config is reloaded and backends change state, then checks that
+// every backend of every generation is left with nothing in flight. Run it
+// with -race.
+func TestReloadUnderLoad(t *testing.T) {
+	configs := []*config{
+		testConfig(
+			backendConfig{Address: "http://127.0.0.1:10001", MaxConnections: 2},
+			backendConfig{Address: "http://127.0.0.1:10002", MaxConnections: 2},
+			backendConfig{Address: "http://127.0.0.1:10003", MaxConnections: 2},
+		),
+		testConfig(
+			backendConfig{Address: "http://127.0.0.1:10002", MaxConnections: 2},
+			backendConfig{Address: "http://127.0.0.1:10003", MaxConnections: 2, Weight: 3},
+			backendConfig{Address: "http://127.0.0.1:10004", MaxConnections: 2},
+		),
+	}
+	configs[1].Pools[0].Strategy = "weighted_round_robin"
+	configs[1].Pools[0].Sticky = stickySettings{Mode: "ip"}
+	for _, cfg := range configs {
+		// requests whose backends were all flipped away give up quickly
+		cfg.Pools[0].Queue.Timeout = duration(20 * time.Millisecond)
+	}
+
+	pr := &poolRegistry{}
+	applyConfig(t, pr, configs[0])
+
+	var mu sync.Mutex
+	seen := map[Server]bool{}
+	remember := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, p := range pr.all() {
+			for _, server := range p.servers {
+				seen[server] = true
+			}
+		}
+	}
+	remember()
+
+	var stop atomic.Bool
+	var background sync.WaitGroup
+	background.Add(2)
+	go func() {
+		defer background.Done()
+		for i := 1; !stop.Load(); i++ {
+			if err := pr.apply(configs[i%2]); err != nil {
+				t.Error(err)
+				return
+			}
+			remember()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	go func() {
+		defer background.Done()
+		for i := 0; !stop.Load(); i++ {
+			p := pr.get("web")
+			server := p.servers[i%len(p.servers)]
+			switch i % 3 {
+			case 0:
+				server.SetAlive(i%2 == 0)
+			case 1:
+				server.Eject(time.Duration(i%2) * time.Millisecond)
+			}
+			time.Sleep(50 * time.Microsecond)
+		}
+	}()
+
+	var served atomic.Int64
+	var clients sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			for i := 0; i < 300; i++ {
+				r := testRequest(g)
+				match := pr.route("8080", r)
+				if match == nil {
+					t.Error("no route for the listener")
+					return
+				}
+				server, err := match.pool.acquire(httptest.NewRecorder(), r)
+				if err != nil {
+					// every backend may be flipped away at once
+					continue
+				}
+				if server.InFlight() > int64(server.MaxConnections()) {
+					t.Errorf("%s has %d requests in flight over its limit", server.Address(), server.InFlight())
+				}
+				time.Sleep(50 * time.Microsecond)
+				match.pool.release(server)
+				served.Add(1)
+			}
+		}()
+	}
+	clients.Wait()
+	stop.Store(true)
+	background.Wait()
+
+	if served.Load() == 0 {
+		t.Fatal("no request was served")
+	}
+	for server := range seen {
+		if n := server.InFlight(); n != 0 {
+			t.Errorf("%s has %d requests in flight, want 0", server.Address(), n)
+		}
+	}
+}
+
+func TestStickyClientWaitsForFullBackend(t *testing.T) {
+	pr := &poolRegistry{}
+	cfg := testConfig(
+		backendConfig{Address: "http://127.0.0.1:10001", MaxConnections: 1},
+		backendConfig{Address: "http://127.0.0.1:10002", MaxConnections: 1},
+	)
+	cfg.Pools[0].Sticky = stickySettings{Mode: "ip"}
+	applyConfig(t, pr, cfg)
+	p := pr.get("web")
+
+	pinned, err := p.acquire(httptest.NewRecorder(), testRequest(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the pinned backend is full, the other one is free
+	acquired := make(chan Server)
+	go func() {
+		server, err := p.acquire(httptest.NewRecorder(), testRequest(1))
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- server
+	}()
+	select {
+	case server := <-acquired:
+		t.Fatalf("the client went to %s instead of waiting for its full backend", server.Address())
+	case <-time.After(50 * time.Millisecond):
+	}
+	p.release(pinned)
+	if server := <-acquired; server != pinned {
+		t.Fatalf("the client got %s, want its pinned %s", server.Address(), pinned.Address())
+	}
+	p.release(pinned)
+
+	// a backend that goes away does re-pin
+	pinned.SetAlive(false)
+	server, err := p.acquire(httptest.NewRecorder(), testRequest(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server == pinned {
+		t.Fatal("the client stayed on its unhealthy backend")
+	}
+	p.release(server)
+	pinned.SetAlive(true)
+	if server, _ := p.pick(httptest.NewRecorder(), testRequest(1)); server == pinned {
+		t.Fatal("the client went back to its old backend after re-pinning")
+	}
+}
+
+// writeCertificate writes a new self-signed certificate to path in PEM.
+func writeCertificate(t *testing.T, path string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "backend"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadPicksUpRotatedCertificates(t *testing.T) {
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	writeCertificate(t, ca)
+	cfg := testConfig(backendConfig{Address: "https://127.0.0.1:10001"})
+	cfg.Pools[0].TLS = &backendTLS{CAFile: ca}
+
+	pr := &poolRegistry{}
+	applyConfig(t, pr, cfg)
+	first := pr.get("web").servers[0]
+
+	applyConfig(t, pr, cfg)
+	if pr.get("web").servers[0] != first {
+		t.Fatal("a backend was replaced though its certificates didn't change")
+	}
+
+	// the same path with a new certificate
+	writeCertificate(t, ca)
+	applyConfig(t, pr, cfg)
+	if pr.get("web").servers[0] == first {
+		t.Fatal("the backend kept the transport of the rotated certificate")
+	}
+	if first.AdminState() != stateDraining {
+		t.Fatalf("the replaced backend is %v, want draining", first.AdminState())
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateLimiter is a set of token buckets, one per key. The key is the client
+// IP, a request header such as an API key, or the route the request matched.
+type rateLimiter struct {
+	source string  // "ip", "header" or "route"
+	name   string  // header name
+	rate   float64 // tokens added per second
+	burst  float64 // bucket size
+
+	buckets   sync.Map // key -> *tokenBucket
+	lastSweep atomic.Int64
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns nil when settings don't set a rate.
+func newRateLimiter(settings *rateLimitSettings) *rateLimiter {
+	if settings == nil || settings.Rate <= 0 {
+		return nil
+	}
+	source, name, _ := strings.Cut(settings.Key, ":")
+	if source == "" {
+		source = "ip"
+	}
+	rl := &rateLimiter{
+		source: source,
+		name:   name,
+		rate:   settings.Rate,
+		burst:  float64(settings.Burst),
+	}
+	if rl.burst < 1 {
+		rl.burst = max(1, settings.Rate)
+	}
+	rl.lastSweep.Store(time.Now().UnixNano())
+	return rl
+}
+
+// allow takes a token for the request. When the bucket is empty it returns
+// false and how long until the next token is available.
+func (rl *rateLimiter) allow(r *http.Request, route string) (bool, time.Duration) {
+	key := rl.key(r, route)
+	now := time.Now()
+
+	v, ok := rl.buckets.Load(key)
+	if !ok {
+		v, _ = rl.buckets.LoadOrStore(key, &tokenBucket{tokens: rl.burst, last: now})
+		rl.sweep(now)
+	}
+	b := v.(*tokenBucket)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+	return false, wait
+}
+
+func (rl *rateLimiter) key(r *http.Request, route string) string {
+	switch rl.source {
+	case "header":
+		// requests without the header share the bucket of their client IP
+		if v := r.Header.Get(rl.name); v != "" {
+			return "header:" + v
+		}
+	case "route":
+		return "route:" + route
+	}
+	return "ip:" + clientIP(r)
+}
+
+// sweep drops buckets that have refilled completely, they behave exactly
+// like a missing bucket. It runs at most once a minute.
+func (rl *rateLimiter) sweep(now time.Time) {
+	last := rl.lastSweep.Load()
+	if now.Sub(time.Unix(0, last)) < time.Minute || !rl.lastSweep.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	refill := time.Duration(rl.burst / rl.rate * float64(time.Second))
+	rl.buckets.Range(func(key, v any) bool {
+		b := v.(*tokenBucket)
+		b.mu.Lock()
+		idle := now.Sub(b.last) > refill
+		b.mu.Unlock()
+		if idle {
+			rl.buckets.Delete(key)
+		}
+		return true
+	})
+}
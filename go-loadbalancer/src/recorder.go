@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// statusRecorder remembers the status code and counts the body bytes written
+// through it. Unwrap lets http.ResponseController reach the underlying
+// writer, so flushing and the hijacking needed for websocket upgrades keep
+// working.
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	headerAt time.Time // when the final status was written
+}
+
+func newStatusRecorder(rw http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{ResponseWriter: rw}
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	// 1xx responses are informational, the final status is still to come
+	if (sr.status == 0 && status >= 200) || status == http.StatusSwitchingProtocols {
+		sr.status = status
+		sr.headerAt = time.Now()
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+		sr.headerAt = time.Now()
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += int64(n)
+	return n, err
+}
+
+// latency is the time from start until the response headers were written,
+// or until now when they weren't. Unlike the total it doesn't grow with the
+// size of the body or the life of an upgraded connection.
+func (sr *statusRecorder) latency(start time.Time) time.Duration {
+	if sr.headerAt.IsZero() {
+		return time.Since(start)
+	}
+	return sr.headerAt.Sub(start)
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// retryPolicy decides whether a request that failed against one backend may
+// be sent to another.
+type retryPolicy struct {
+	attempts int // retries after the first try, 0 disables retrying
+	budget   *retryBudget
+}
+
+func (rp *retryPolicy) allow(r *http.Request, retries int) bool {
+	return retries < rp.attempts && isIdempotent(r) && isReplayable(r) && rp.budget.withdraw()
+}
+
+// allowConn is allow for a passthrough connection whose backend couldn't be
+// dialed, nothing was sent yet so it can always be replayed.
+func (rp *retryPolicy) allowConn(retries int) bool {
+	return retries < rp.attempts && rp.budget.withdraw()
+}
+
+// retryBudget caps retries to a fraction of the traffic so that a failing
+// pool isn't hit with extra load from retries. Every request deposits ratio
+// tokens, every retry takes one whole token. Tokens are kept in thousandths
+// so the balance can live in a single atomic.
+type retryBudget struct {
+	deposit int64
+	balance atomic.Int64
+}
+
+const (
+	retryTokenScale  = 1000
+	retryBudgetBurst = 10 // tokens available up front and the most that can be saved
+)
+
+func newRetryBudget(ratio float64) *retryBudget {
+	rb := &retryBudget{deposit: int64(ratio * retryTokenScale)}
+	rb.balance.Store(retryBudgetBurst * retryTokenScale)
+	return rb
+}
+
+func (rb *retryBudget) recordRequest() {
+	for {
+		balance := rb.balance.Load()
+		next := min(balance+rb.deposit, retryBudgetBurst*retryTokenScale)
+		if next == balance || rb.balance.CompareAndSwap(balance, next) {
+			return
+		}
+	}
+}
+
+func (rb *retryBudget) withdraw() bool {
+	for {
+		balance := rb.balance.Load()
+		if balance < retryTokenScale {
+			return false
+		}
+		if rb.balance.CompareAndSwap(balance, balance-retryTokenScale) {
+			return true
+		}
+	}
+}
+
+func isIdempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isReplayable reports whether the request can be sent again, the body of a
+// server request can only be read once.
+func isReplayable(r *http.Request) bool {
+	return r.Body == nil || r.Body == http.NoBody
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// route sends requests matching every non-empty condition to a named pool.
+type route struct {
+	host       string // exact host, or "*.example.com" for any subdomain
+	pathPrefix string
+	methods    []string
+	headers    map[string]string
+	pool       string
+	cache      bool
+}
+
+func newRoute(rc routeConfig) route {
+	methods := make([]string, len(rc.Methods))
+	for i, m := range rc.Methods {
+		methods[i] = strings.ToUpper(m)
+	}
+	return route{
+		host:       strings.ToLower(rc.Host),
+		pathPrefix: rc.PathPrefix,
+		methods:    methods,
+		headers:    rc.Headers,
+		pool:       rc.Pool,
+		cache:      rc.Cache,
+	}
+}
+
+func (rt *route) matches(r *http.Request) bool {
+	if rt.host != "" && !matchHost(rt.host, requestHost(r)) {
+		return false
+	}
+	if rt.pathPrefix != "" && !strings.HasPrefix(r.URL.Path, rt.pathPrefix) {
+		return false
+	}
+	if len(rt.methods) > 0 && !slices.Contains(rt.methods, r.Method) {
+		return false
+	}
+	for name, value := range rt.headers {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// router picks the pool for a listener: the first matching route wins and
+// the listener's default pool, if any, catches the rest.
+type router struct {
+	routes       []route
+	defaultPool  string
+	defaultCache bool
+	limiter      *rateLimiter
+}
+
+func newRouter(lc listenerConfig) *router {
+	rt := &router{
+		defaultPool:  lc.Pool,
+		defaultCache: lc.Cache,
+		limiter:      newRateLimiter(lc.RateLimit),
+	}
+	for _, rc := range lc.Routes {
+		rt.routes = append(rt.routes, newRoute(rc))
+	}
+	return rt
+}
+
+// poolFor returns the name of the pool for r, or "" when nothing matches,
+// along with a name for the route that matched and whether it caches.
+func (rt *router) poolFor(r *http.Request) (pool string, route string, cache bool) {
+	for i := range rt.routes {
+		if rt.routes[i].matches(r) {
+			return rt.routes[i].pool, strconv.Itoa(i), rt.routes[i].cache
+		}
+	}
+	return rt.defaultPool, "default", rt.defaultCache
+}
+
+// routeMatch is where a request on a listener goes.
+type routeMatch struct {
+	pool    *pool
+	route   string
+	cache   bool
+	limiter *rateLimiter
+}
+
+func matchHost(pattern string, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix)
+	}
+	return pattern == host
+}
+
+// requestHost is the Host header lower-cased and without its port.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stickySessions pins clients to the backend they were first sent to, either
+// through a cookie naming the backend or by remembering the client IP. When
+// the pinned backend can't take requests the client is re-pinned to whatever
+// the balancing strategy picks next, a backend at its connection limit is
+// waited for instead.
+type stickySessions struct {
+	mode       string // "cookie" or "ip"
+	cookieName string
+	ttl        time.Duration
+	byID       map[string]Server // cookie value -> server
+
+	pins      sync.Map // client IP -> *ipPin
+	lastSweep atomic.Int64
+}
+
+type ipPin struct {
+	server   Server
+	lastUsed atomic.Int64 // unix nanoseconds
+}
+
+// newStickySessions returns nil when stickiness is off. IP pins of the
+// previous generation are carried over for servers that survived the reload.
+func newStickySessions(settings stickySettings, servers []Server, prev *stickySessions) *stickySessions {
+	if settings.Mode == "" {
+		return nil
+	}
+
+	ss := &stickySessions{
+		mode:       settings.Mode,
+		cookieName: "lb_sticky",
+		ttl:        time.Hour,
+		byID:       make(map[string]Server, len(servers)),
+	}
+	if settings.CookieName != "" {
+		ss.cookieName = settings.CookieName
+	}
+	if settings.TTL > 0 {
+		ss.ttl = time.Duration(settings.TTL)
+	}
+	for _, server := range servers {
+		ss.byID[serverID(server)] = server
+	}
+	ss.lastSweep.Store(time.Now().UnixNano())
+
+	if prev != nil && prev.mode == "ip" && ss.mode == "ip" {
+		prev.pins.Range(func(ip, v any) bool {
+			if slices.Contains(servers, v.(*ipPin).server) {
+				ss.pins.Store(ip, v)
+			}
+			return true
+		})
+	}
+	return ss
+}
+
+// pinned returns the server the client of r is pinned to, or nil when it
+// isn't pinned or its server can't take the request. A server that is only
+// at its connection limit is still returned, the request waits for it.
+func (ss *stickySessions) pinned(r *http.Request, exclude []Server) Server {
+	var server Server
+	switch ss.mode {
+	case "cookie":
+		c, err := r.Cookie(ss.cookieName)
+		if err != nil {
+			return nil
+		}
+		server = ss.byID[c.Value]
+	case "ip":
+		v, ok := ss.pins.Load(clientIP(r))
+		if !ok {
+			return nil
+		}
+		pin := v.(*ipPin)
+		if time.Since(time.Unix(0, pin.lastUsed.Load())) > ss.ttl {
+			return nil
+		}
+		pin.lastUsed.Store(time.Now().UnixNano())
+		server = pin.server
+	}
+
+	if server == nil || !usable(server) || slices.Contains(exclude, server) {
+		return nil
+	}
+	return server
+}
+
+// pin remembers server for the client of r.
+func (ss *stickySessions) pin(rw http.ResponseWriter, r *http.Request, server Server) {
+	switch ss.mode {
+	case "cookie":
+		// a retry re-pins, drop the cookie set for the failed attempt
+		header := rw.Header()
+		header["Set-Cookie"] = slices.DeleteFunc(header["Set-Cookie"], func(v string) bool {
+			return strings.HasPrefix(v, ss.cookieName+"=")
+		})
+		http.SetCookie(rw, &http.Cookie{
+			Name:     ss.cookieName,
+			Value:    serverID(server),
+			Path:     "/",
+			MaxAge:   int(ss.ttl.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	case "ip":
+		pin := &ipPin{server: server}
+		pin.lastUsed.Store(time.Now().UnixNano())
+		ss.pins.Store(clientIP(r), pin)
+		ss.sweep()
+	}
+}
+
+// sweep drops expired IP pins, at most once per ttl.
+func (ss *stickySessions) sweep() {
+	last := ss.lastSweep.Load()
+	now := time.Now()
+	if now.Sub(time.Unix(0, last)) < ss.ttl || !ss.lastSweep.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	ss.pins.Range(func(ip, v any) bool {
+		if now.Sub(time.Unix(0, v.(*ipPin).lastUsed.Load())) > ss.ttl {
+			ss.pins.Delete(ip)
+		}
+		return true
+	})
+}
+
+// serverID names a server in the sticky cookie without exposing its address.
+func serverID(server Server) string {
+	h := fnv.New64a()
+	h.Write([]byte(server.Address()))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// Strategy picks the server that should handle a request. Implementations
+// must skip servers that are not available and return nil when none is left.
+// Next is called from every handler goroutine at once, so implementations
+// keep their state in atomics rather than behind a lock.
+type Strategy interface {
+	Next(servers []Server, r *http.Request) Server
+}
+
+// roundRobin hands requests to each available server in turn.
+type roundRobin struct {
+	count atomic.Uint64
+}
+
+func (rr *roundRobin) Next(servers []Server, r *http.Request) Server {
+	for i := 0; i < len(servers); i++ {
+		n := rr.count.Add(1) - 1
+		server := servers[n%uint64(len(servers))]
+		if server.Available() {
+			return server
+		}
+	}
+	return nil
+}
+
+// weightedRoundRobin behaves like roundRobin but a server with weight n gets
+// n consecutive turns per cycle.
+type weightedRoundRobin struct {
+	count atomic.Uint64
+}
+
+func (wrr *weightedRoundRobin) Next(servers []Server, r *http.Request) Server {
+	// take one snapshot of the available set, a health flip between summing the
+	// weights and walking them would otherwise skew the pick
+	available := availableServers(servers)
+	total := 0
+	for _, server := range available {
+		total += server.Weight()
+	}
+	if total == 0 {
+		return nil
+	}
+
+	n := int((wrr.count.Add(1) - 1) % uint64(total))
+	for _, server := range available {
+		if n < server.Weight() {
+			return server
+		}
+		n -= server.Weight()
+	}
+	return nil
+}
+
+// leastConnections picks the available server with the fewest in-flight requests
+// relative to its weight.
+type leastConnections struct{}
+
+func (leastConnections) Next(servers []Server, r *http.Request) Server {
+	var best Server
+	for _, server := range servers {
+		if !server.Available() {
+			continue
+		}
+		if best == nil || lessLoaded(server, best) {
+			best = server
+		}
+	}
+	return best
+}
+
+// randomTwoChoices samples two available servers at random and keeps the less
+// loaded one, which avoids the herd effect of a global least-connections scan.
+type randomTwoChoices struct{}
+
+func (randomTwoChoices) Next(servers []Server, r *http.Request) Server {
+	available := availableServers(servers)
+	switch len(available) {
+	case 0:
+		return nil
+	case 1:
+		return available[0]
+	}
+
+	i := rand.IntN(len(available))
+	j := rand.IntN(len(available) - 1)
+	if j >= i {
+		j++
+	}
+	if lessLoaded(available[j], available[i]) {
+		return available[j]
+	}
+	return available[i]
+}
+
+// consistentHash maps a request key (header, cookie or client IP) to a
+// server using weighted rendezvous hashing, so a key keeps landing on the
+// same server and only the keys of a removed server move elsewhere.
+type consistentHash struct {
+	source string // "header", "cookie" or "ip"
+	name   string // header or cookie name
+}
+
+func (ch *consistentHash) Next(servers []Server, r *http.Request) Server {
+	key := ch.key(r)
+
+	var best Server
+	bestScore := math.Inf(-1)
+	for _, server := range servers {
+		if !server.Available() {
+			continue
+		}
+		score := rendezvousScore(key, server)
+		if score > bestScore {
+			best, bestScore = server, score
+		}
+	}
+	return best
+}
+
+// key extracts the hash key from the request, falling back to the client IP
+// when the configured header or cookie is missing.
+func (ch *consistentHash) key(r *http.Request) string {
+	switch ch.source {
+	case "header":
+		if v := r.Header.Get(ch.name); v != "" {
+			return v
+		}
+	case "cookie":
+		if c, err := r.Cookie(ch.name); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+	return clientIP(r)
+}
+
+func rendezvousScore(key string, server Server) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(server.Address()))
+	x := mix64(h.Sum64())
+
+	// map the hash to (0,1) and weight it, see "weighted rendezvous hashing"
+	u := (float64(x>>11) + 0.5) / (1 << 53)
+	return -float64(server.Weight()) / math.Log(u)
+}
+
+// mix64 is the splitmix64 finalizer, FNV alone spreads similar keys poorly.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// lessLoaded reports whether a has fewer in-flight requests per unit of
+// weight than b.
+func lessLoaded(a, b Server) bool {
+	return a.InFlight()*int64(b.Weight()) < b.InFlight()*int64(a.Weight())
+}
+
+func availableServers(servers []Server) []Server {
+	available := make([]Server, 0, len(servers))
+	for _, server := range servers {
+		if server.Available() {
+			available = append(available, server)
+		}
+	}
+	return available
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var strategyNames = []string{"round_robin", "weighted_round_robin", "least_connections", "random_two_choices", "consistent_hash"}
+
+// testServers returns servers with the given weights, nothing listens on
+// their addresses.
+func testServers(weights ...int) []Server {
+	servers := make([]Server, len(weights))
+	for i, weight := range weights {
+		servers[i] = newSimpleServer(fmt.Sprintf("http://127.0.0.1:%d", 10000+i), weight, 0, nil)
+	}
+	return servers
+}
+
+func testRequest(client int) *http.Request {
+	r, _ := http.NewRequest("GET", "http://lb/", nil)
+	r.RemoteAddr = fmt.Sprintf("10.0.%d.%d:40000", client/256, client%256)
+	return r
+}
+
+func TestStrategiesSkipUnavailableServers(t *testing.T) {
+	for _, name := range strategyNames {
+		t.Run(name, func(t *testing.T) {
+			strategy, err := newStrategy(name, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			servers := testServers(1, 2, 3, 1)
+			servers[0].SetAlive(false)
+			servers[1].Eject(time.Minute)
+			servers[2].SetAdminState(stateDisabled)
+
+			for i := 0; i < 100; i++ {
+				if got := strategy.Next(servers, testRequest(i)); got != servers[3] {
+					t.Fatalf("Next picked %v, want the only available %s", got, servers[3].Address())
+				}
+			}
+			servers[3].SetAdminState(stateDraining)
+			if got := strategy.Next(servers, testRequest(0)); got != nil {
+				t.Fatalf("Next picked %s with no server available", got.Address())
+			}
+		})
+	}
+}
+
+func TestRoundRobinTakesTurns(t *testing.T) {
+	servers := testServers(1, 1, 1)
+	rr := &roundRobin{}
+	for i := 0; i < 9; i++ {
+		if got := rr.Next(servers, testRequest(0)); got != servers[i%3] {
+			t.Fatalf("pick %d went to %s, want %s", i, got.Address(), servers[i%3].Address())
+		}
+	}
+}
+
+func TestWeightedRoundRobinFollowsWeights(t *testing.T) {
+	servers := testServers(1, 2, 3)
+	wrr := &weightedRoundRobin{}
+	counts := map[Server]int{}
+	for i := 0; i < 600; i++ {
+		counts[wrr.Next(servers, testRequest(0))]++
+	}
+	for i, want := range []int{100, 200, 300} {
+		if counts[servers[i]] != want {
+			t.Fatalf("%s got %d picks, want %d", servers[i].Address(), counts[servers[i]], want)
+		}
+	}
+}
+
+func TestConsistentHashSticksToClient(t *testing.T) {
+	servers := testServers(1, 1, 1, 1)
+	ch, _ := newStrategy("consistent_hash", "ip")
+	for client := 0; client < 50; client++ {
+		first := ch.Next(servers, testRequest(client))
+		for i := 0; i < 5; i++ {
+			if got := ch.Next(servers, testRequest(client)); got != first {
+				t.Fatalf("client %d moved from %s to %s", client, first.Address(), got.Address())
+			}
+		}
+	}
+}
+
+// TestStrategiesUnderStateFlips runs every strategy from many goroutines
+// while the servers are marked unhealthy, ejected and disabled, as the
+// health checker, outlier detection and the admin API do. Run it with -race.
+func TestStrategiesUnderStateFlips(t *testing.T) {
+	for _, name := range strategyNames {
+		t.Run(name, func(t *testing.T) {
+			strategy, err := newStrategy(name, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			servers := testServers(1, 2, 3, 4)
+			// the first server is never touched, so a pick is always
+			// possible
+			flipped := servers[1:]
+
+			var stop atomic.Bool
+			var flips sync.WaitGroup
+			flips.Add(1)
+			go func() {
+				defer flips.Done()
+				for i := 0; !stop.Load(); i++ {
+					server := flipped[i%len(flipped)]
+					switch i % 3 {
+					case 0:
+						server.SetAlive(i%2 == 0)
+					case 1:
+						server.Eject(time.Duration(i%2) * time.Millisecond)
+					case 2:
+						server.SetAdminState(adminState(i % 2))
+					}
+				}
+			}()
+
+			var pickers sync.WaitGroup
+			for g := 0; g < 8; g++ {
+				pickers.Add(1)
+				go func() {
+					defer pickers.Done()
+					for i := 0; i < 2000; i++ {
+						server := strategy.Next(servers, testRequest(g*2000+i))
+						if server == nil {
+							t.Error("Next found no server, the first one is always available")
+							return
+						}
+						if !slices.Contains(servers, server) {
+							t.Errorf("Next picked %s, which isn't one of the servers", server.Address())
+							return
+						}
+						// least_connections and random_two_choices look at
+						// the load
+						server.Acquire()
+						server.Release()
+					}
+				}()
+			}
+			pickers.Wait()
+			stop.Store(true)
+			flips.Wait()
+
+			for _, server := range servers {
+				if n := server.InFlight(); n != 0 {
+					t.Errorf("%s has %d requests in flight, want 0", server.Address(), n)
+				}
+			}
+		})
+	}
+}
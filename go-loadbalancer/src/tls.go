@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+)
+
+// listenerTLS terminates TLS on a listener. The certificate is picked by SNI
+// among Certificates, clients that negotiate it get HTTP/2.
+type listenerTLS struct {
+	Certificates     []certificateConfig `json:"certificates"`
+	RedirectHTTPPort string              `json:"redirect_http_port"`
+}
+
+type certificateConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// backendTLS configures the connection to the backends of a pool: a custom
+// CA to verify them, and a client certificate for mutual TLS.
+type backendTLS struct {
+	CAFile             string `json:"ca_file"`
+	CertFile           string `json:"cert_file"`
+	KeyFile            string `json:"key_file"`
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+func (lt *listenerTLS) config() (*tls.Config, error) {
+	if len(lt.Certificates) == 0 {
+		return nil, fmt.Errorf("tls needs at least one certificate")
+	}
+	certs := make([]tls.Certificate, 0, len(lt.Certificates))
+	for _, c := range lt.Certificates {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load certificate %s: %w", c.CertFile, err)
+		}
+		certs = append(certs, cert)
+	}
+	// crypto/tls picks the certificate matching the SNI name of the client
+	// hello and falls back to the first one
+	return &tls.Config{
+		Certificates: certs,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// backendTLSFiles are the contents of the files a backendTLS names. A
+// reload compares them, the paths stay the same when certificates are
+// rotated.
+type backendTLSFiles struct {
+	ca, cert, key []byte
+}
+
+// transport returns the transport used for proxying and health checks to
+// the pool's backends, nil means http.DefaultTransport, along with the files
+// it was built from.
+func (bt *backendTLS) transport() (*http.Transport, backendTLSFiles, error) {
+	var files backendTLSFiles
+	if bt == nil {
+		return nil, files, nil
+	}
+
+	config := &tls.Config{
+		ServerName:         bt.ServerName,
+		InsecureSkipVerify: bt.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if bt.CAFile != "" {
+		var err error
+		if files.ca, err = os.ReadFile(bt.CAFile); err != nil {
+			return nil, files, fmt.Errorf("read ca: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(files.ca) {
+			return nil, files, fmt.Errorf("no certificates found in %s", bt.CAFile)
+		}
+	}
+	if bt.CertFile != "" || bt.KeyFile != "" {
+		var err error
+		if files.cert, err = os.ReadFile(bt.CertFile); err != nil {
+			return nil, files, fmt.Errorf("load client certificate: %w", err)
+		}
+		if files.key, err = os.ReadFile(bt.KeyFile); err != nil {
+			return nil, files, fmt.Errorf("load client certificate: %w", err)
+		}
+		cert, err := tls.X509KeyPair(files.cert, files.key)
+		if err != nil {
+			return nil, files, fmt.Errorf("load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return transport, files, nil
+}
+
+// redirectToHTTPS sends plain HTTP clients to the same URL over HTTPS on
+// httpsPort. 308 keeps the method and body of the request.
+func redirectToHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		host := requestHost(r)
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(rw, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}